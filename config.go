@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// envPrefix starts the environment variable of every flag, like
+// HOSTYOSELF_CACHE_SIZE for --cache-size
+const envPrefix = "HOSTYOSELF_"
+
+// withEnv lets every flag be set by its environment variable
+func withEnv(flags []cli.Flag) []cli.Flag {
+	env := func(name string) string {
+		name = strings.TrimSpace(strings.Split(name, ",")[0])
+		return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+	}
+	for i, f := range flags {
+		switch f := f.(type) {
+		case cli.StringFlag:
+			f.EnvVar = env(f.Name)
+			flags[i] = f
+		case cli.StringSliceFlag:
+			f.EnvVar = env(f.Name)
+			flags[i] = f
+		case cli.BoolFlag:
+			f.EnvVar = env(f.Name)
+			flags[i] = f
+		case cli.IntFlag:
+			f.EnvVar = env(f.Name)
+			flags[i] = f
+		case cli.Int64Flag:
+			f.EnvVar = env(f.Name)
+			flags[i] = f
+		case cli.DurationFlag:
+			f.EnvVar = env(f.Name)
+			flags[i] = f
+		}
+	}
+	return flags
+}
+
+// readConfig reads a YAML file, or a TOML file if it ends in .toml
+func readConfig(file string) (config map[string]interface{}, err error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	if strings.ToLower(filepath.Ext(file)) == ".toml" {
+		_, err = toml.Decode(string(b), &config)
+	} else {
+		err = yaml.Unmarshal(b, &config)
+	}
+	if err != nil {
+		err = fmt.Errorf("problem reading '%s': %s", file, err.Error())
+	}
+	return
+}
+
+// loadConfig sets the flags of a command from the file given with
+// --config, keeping those set on the command line or by environment
+// variables. Keys are named like the flags, and other keys it may
+// have are returned for the command to read.
+func loadConfig(c *cli.Context, others ...string) (config map[string]interface{}, err error) {
+	file := c.String("config")
+	if file == "" {
+		return
+	}
+	config, err = readConfig(file)
+	if err != nil {
+		return
+	}
+
+	names := make(map[string]bool)
+	for _, f := range c.Command.Flags {
+		names[strings.TrimSpace(strings.Split(f.GetName(), ",")[0])] = true
+	}
+	delete(names, "config")
+	delete(names, "dump-config")
+	delete(names, "help")
+	for _, other := range others {
+		names[other] = false
+	}
+	for name, value := range config {
+		isFlag, ok := names[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown option '%s' in '%s'", name, file)
+		}
+		if !isFlag || c.IsSet(name) {
+			continue
+		}
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			err = c.Set(name, fmt.Sprint(v))
+			if err != nil {
+				return nil, fmt.Errorf("bad %s in '%s': %s", name, file, err.Error())
+			}
+		}
+	}
+	return
+}
+
+// dumpConfig prints the options a command ends up with, as a YAML
+// config file that can be used in their place
+func dumpConfig(c *cli.Context, others ...yaml.MapItem) error {
+	var config yaml.MapSlice
+	for _, f := range c.Command.Flags {
+		name := strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+		if name == "config" || name == "dump-config" || name == "help" {
+			continue
+		}
+		var value interface{}
+		switch f.(type) {
+		case cli.StringFlag:
+			value = c.String(name)
+		case cli.StringSliceFlag:
+			value = c.StringSlice(name)
+		case cli.BoolFlag:
+			value = c.Bool(name)
+		case cli.IntFlag:
+			value = c.Int(name)
+		case cli.Int64Flag:
+			value = c.Int64(name)
+		case cli.DurationFlag:
+			value = c.Duration(name).String()
+		}
+		if value == nil {
+			continue
+		}
+		config = append(config, yaml.MapItem{Key: name, Value: value})
+	}
+	config = append(config, others...)
+	b, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(b)
+	return err
+}
@@ -1,14 +1,22 @@
 module github.com/schollz/hostyoself
 
-go 1.12
+go 1.18
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gorilla/websocket v1.4.0
 	github.com/h2non/filetype v1.0.8
-	github.com/jteeuwen/go-bindata v3.0.7+incompatible // indirect
 	github.com/schollz/logger v1.0.1
 	github.com/urfave/cli v1.20.0
 	github.com/vincent-petithory/dataurl v0.0.0-20160330182126-9a301d65acbb
+	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
+	gopkg.in/yaml.v2 v2.2.2
+)
+
+require (
+	github.com/jteeuwen/go-bindata v3.0.7+incompatible // indirect
+	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3 // indirect
 	golang.org/x/sys v0.0.0-20190710143415-6ec70d6a5542 // indirect
+	golang.org/x/text v0.3.0 // indirect
 )
@@ -1,6 +1,6 @@
 package main
 
-//go:generate go get -v github.com/jteeuwen/go-bindata/go-bindata
+//go:generate go install github.com/jteeuwen/go-bindata/go-bindata
 //go:generate go-bindata -pkg server -o pkg/server/assets.go templates/ static/
 
 import (
@@ -11,10 +11,10 @@ import (
 	"strings"
 	"time"
 
-	"github.com/schollz/hostyoself/pkg/client"
 	"github.com/schollz/hostyoself/pkg/server"
 	log "github.com/schollz/logger"
 	"github.com/urfave/cli"
+	yaml "gopkg.in/yaml.v2"
 )
 
 func init() {
@@ -40,10 +40,23 @@ func main() {
 			Name:        "relay",
 			Usage:       "start a relay",
 			Description: "relay is used to transit files",
-			Flags: []cli.Flag{
+			Flags: withEnv([]cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "", Usage: "YAML or TOML file of options, named like the flags"},
+				cli.BoolFlag{Name: "dump-config", Usage: "print the options in effect as YAML and exit"},
 				cli.StringFlag{Name: "url, u", Value: "localhost", Usage: "public URL to use"},
 				cli.StringFlag{Name: "port", Value: "8010", Usage: "ports of the local relay"},
-			},
+				cli.BoolFlag{Name: "subdomains", Usage: "serve each domain on its own subdomain (needs wildcard DNS)"},
+				cli.Int64Flag{Name: "cache-size", Value: 0, Usage: "megabytes of files to cache in memory (0 disables caching)"},
+				cli.DurationFlag{Name: "cache-ttl", Value: 10 * time.Minute, Usage: "how long to keep cached files"},
+				cli.StringFlag{Name: "tls-cert", Value: "", Usage: "certificate file to serve HTTPS"},
+				cli.StringFlag{Name: "tls-key", Value: "", Usage: "key file of the certificate"},
+				cli.BoolFlag{Name: "acme", Usage: "get a certificate for the public URL automatically"},
+				cli.StringFlag{Name: "acme-email", Value: "", Usage: "contact email for the ACME server"},
+				cli.StringFlag{Name: "acme-cache", Value: "certs", Usage: "folder to keep certificates in"},
+				cli.StringFlag{Name: "acme-directory", Value: "", Usage: "ACME directory URL (default is Let's Encrypt)"},
+				cli.StringFlag{Name: "acme-ca", Value: "", Usage: "PEM file with the root certificate of the ACME server"},
+				cli.StringFlag{Name: "acme-http-port", Value: "", Usage: "port for http-01 challenges and redirects to HTTPS"},
+			}),
 			HelpName: "hostyoself relay",
 			Action: func(c *cli.Context) error {
 				return relay(c)
@@ -54,20 +67,37 @@ func main() {
 			Usage:       "host files from your computer",
 			Description: "host files from your computer",
 			HelpName:    "hostyoself relay",
-			Flags: []cli.Flag{
+			Flags: withEnv([]cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "", Usage: "YAML or TOML file of options named like the flags, and of sites to host"},
+				cli.BoolFlag{Name: "dump-config", Usage: "print the options in effect as YAML and exit"},
 				cli.StringFlag{Name: "url, u", Value: "https://hostyoself.com", Usage: "URL of relay to connect"},
-				cli.StringFlag{Name: "domain, d", Value: "", Usage: "domain to use (default is random)"},
-				cli.StringFlag{Name: "key, k", Value: "", Usage: "key value to use (default is random)"},
+				cli.StringFlag{Name: "domain, d", Value: "", Usage: "domain to use (default is the last one used for the folder, or random)"},
+				cli.StringFlag{Name: "key, k", Value: "", Usage: "key value to use (default is the last one used for the folder, or random)"},
+				cli.BoolFlag{Name: "new-identity", Usage: "pick a new random domain and key instead of the ones saved for the folder"},
 				cli.StringFlag{Name: "folder, f", Value: ".", Usage: "folder to serve files"},
-			},
+				cli.StringSliceFlag{Name: "mount", Usage: "/prefix=folder to serve a folder under a path (can be repeated)"},
+				cli.StringFlag{Name: "proxy", Value: "", Usage: "URL of a local server to expose instead of a folder"},
+				cli.StringFlag{Name: "hostname", Value: "", Usage: "custom hostname to serve on, pointed at the relay with a CNAME"},
+				cli.StringFlag{Name: "password", Value: "", Usage: "password visitors need to see the site"},
+				cli.StringSliceFlag{Name: "user", Usage: "user:password visitors can log in with (can be repeated)"},
+				cli.StringSliceFlag{Name: "link", Usage: "file to only share through a signed link (can be repeated)"},
+				cli.DurationFlag{Name: "link-expires", Value: time.Hour, Usage: "how long links work (0 for forever)"},
+				cli.IntFlag{Name: "link-downloads", Value: 0, Usage: "how many times links can be used (0 for any)"},
+				cli.StringSliceFlag{Name: "exclude", Usage: "gitignore pattern of files to keep out of the site (can be repeated)"},
+				cli.StringSliceFlag{Name: "include", Usage: "gitignore pattern of files to serve even if ignored (can be repeated)"},
+				cli.BoolFlag{Name: "follow-symlinks", Usage: "serve files that are symlinks, wherever they point"},
+				cli.BoolFlag{Name: "allow-upload", Usage: "let visitors upload files"},
+				cli.StringFlag{Name: "upload-folder", Value: "uploads", Usage: "path of the site to save uploads in"},
+				cli.Int64Flag{Name: "upload-limit", Value: 100, Usage: "megabytes each upload can be (0 for any)"},
+			}),
 			Action: func(c *cli.Context) error {
 				return host(c)
 			},
 		},
 	}
-	app.Flags = []cli.Flag{
+	app.Flags = withEnv([]cli.Flag{
 		cli.BoolFlag{Name: "debug", Usage: "increase verbosity"},
-	}
+	})
 	app.EnableBashCompletion = true
 	app.HideHelp = false
 	app.HideVersion = false
@@ -78,6 +108,7 @@ func main() {
 	err := app.Run(os.Args)
 	if err != nil {
 		log.Debug(err)
+		os.Exit(1)
 	}
 }
 
@@ -88,19 +119,39 @@ func host(c *cli.Context) (err error) {
 		log.SetLevel("info")
 	}
 
-	cl, err := client.New(c.String("domain"), c.String("key"), c.String("url"), c.String("folder"))
+	// folders given as flags are relative to the working folder, but
+	// the config file sets the flags it has too
+	flagged := map[string]bool{"folder": c.IsSet("folder"), "mount": c.IsSet("mount")}
+	config, err := loadConfig(c, "sites")
 	if err != nil {
+		log.Error(err)
 		return
 	}
-	for {
-		log.Info("serving forever")
-		err = cl.Run()
+	sites := []site{siteFromFlags(c, flagged)}
+	if raw, ok := config["sites"]; ok {
+		sites, err = readSites(raw, c.String("config"), sites[0])
 		if err != nil {
-			log.Debug(err)
+			log.Error(err)
+			return
+		}
+		if c.Bool("dump-config") {
+			return dumpConfig(c, yaml.MapItem{Key: "sites", Value: sites})
+		}
+	}
+	if c.Bool("dump-config") {
+		return dumpConfig(c)
+	}
+	var hs []hosted
+	for _, s := range sites {
+		h, errHost := s.host()
+		if errHost != nil {
+			log.Error(errHost)
+			return errHost
 		}
-		log.Infof("server disconnected, retrying in 10 seconds")
-		time.Sleep(10 * time.Second)
+		hs = append(hs, h)
 	}
+	supervise(hs)
+	return
 }
 
 func relay(c *cli.Context) (err error) {
@@ -110,14 +161,52 @@ func relay(c *cli.Context) (err error) {
 		log.SetLevel("info")
 	}
 
+	_, err = loadConfig(c)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if c.Bool("dump-config") {
+		return dumpConfig(c)
+	}
+
+	if (c.String("tls-cert") == "") != (c.String("tls-key") == "") {
+		err = fmt.Errorf("both --tls-cert and --tls-key are needed")
+		log.Error(err)
+		return
+	}
+	secure := c.String("tls-cert") != "" || c.Bool("acme")
+
 	flagPublicURL := c.String("url")
 	if flagPublicURL == "localhost" {
 		flagPublicURL += ":" + c.String("port")
 	}
 	if !strings.HasPrefix(flagPublicURL, "http") {
-		flagPublicURL = "http://" + flagPublicURL
+		if secure {
+			flagPublicURL = "https://" + flagPublicURL
+		} else {
+			flagPublicURL = "http://" + flagPublicURL
+		}
 	}
 
 	s := server.New(flagPublicURL, c.String("port"))
-	return s.Run()
+	s.Subdomains = c.Bool("subdomains")
+	s.CacheSize = c.Int64("cache-size") << 20
+	s.CacheTTL = c.Duration("cache-ttl")
+	s.TLSCert = c.String("tls-cert")
+	s.TLSKey = c.String("tls-key")
+	if c.Bool("acme") {
+		s.ACME = &server.ACME{
+			Email:        c.String("acme-email"),
+			CacheDir:     c.String("acme-cache"),
+			DirectoryURL: c.String("acme-directory"),
+			RootCA:       c.String("acme-ca"),
+			HTTPPort:     c.String("acme-http-port"),
+		}
+	}
+	err = s.Run()
+	if err != nil {
+		log.Error(err)
+	}
+	return
 }
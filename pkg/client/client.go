@@ -3,12 +3,18 @@ package client
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/schollz/hostyoself/pkg/namesgenerator"
 	"github.com/schollz/hostyoself/pkg/server"
@@ -25,11 +31,82 @@ type client struct {
 	WebsocketURL string
 	Domain       string
 	Key          string
-	Folder       string
-	fileList     map[string]struct{}
+	// Secret signs the tokens and links printed for the site, which
+	// would give away Key to anyone trying every key if it signed them
+	Secret string
+	// Folder is served at the root of the site, and Mounts under
+	// their prefixes, where the longest prefix of a path wins
+	Folder string
+	Mounts []Mount
+	// mounted are the folders being watched
+	mounted []*mount
+	// Label is put before what is logged about each request, to
+	// tell sites apart when several are hosted at once
+	Label string
+	// Proxy is the URL of a local HTTP server to forward requests
+	// to instead of serving files from Folder
+	Proxy string
+	// Hostname is a custom hostname to serve the domain on, which
+	// is pointed at the relay with a CNAME
+	Hostname string
+	// Passwords are what visitors need to see the site by user,
+	// where an empty user takes any user. The site is public if empty.
+	Passwords map[string]string
+	// Links are files only shared through signed links
+	Links []Link
+	// Upload is the folder of the site where files uploaded by
+	// visitors are saved, which are refused if it is empty.
+	// UploadLimit is the most bytes of each file, if set.
+	Upload      string
+	UploadLimit int64
+	// Exclude and Include are gitignore patterns for files to keep
+	// out of the site, and to keep in it even if they are ignored
+	Exclude []string
+	Include []string
+	// FollowSymlinks serves files through symlinks wherever they
+	// point, which are left out otherwise
+	FollowSymlinks bool
+	// fileList is the index of the files in Folder, and settling
+	// the files that changed and are about to be looked at again
+	fileList map[string]*indexEntry
+	settling map[string]*time.Timer
+
+	// publicURL is where the domain is expected to be served, and
+	// printedURL where the relay said it is
+	publicURL  string
+	printedURL string
+
+	// binary is set when the relay accepts chunks as binary frames,
+	// and credit when it grants credit for them
+	binary bool
+	credit bool
+	// ws is the connection to the relay while there is one
+	ws *wsconn.WebsocketConn
+
+	// cancels holds a channel for each request being served
+	// which is closed if the relay cancels the request
+	cancels map[int64]chan struct{}
+	// credits holds a channel for each response being sent which
+	// gets the chunks the relay grants for it
+	credits map[int64]chan int
+	// uploads holds the files being uploaded by request ID
+	uploads map[int64]*upload
+	// watching starts watching the folders once
+	watching sync.Once
 	sync.Mutex
 }
 
+// Link shares a file until it expires (never if zero) for a number
+// of downloads (any if zero)
+type Link struct {
+	Path      string
+	Expires   time.Time
+	Downloads int
+}
+
+// chunkSize is the number of bytes of a file sent in each chunk
+const chunkSize = 64 * 1024
+
 // New returns a new client
 func New(domain, key, webocketURL, folder string) (c *client, err error) {
 	if strings.HasPrefix(webocketURL, "http") {
@@ -49,6 +126,11 @@ func New(domain, key, webocketURL, folder string) (c *client, err error) {
 		folder = "."
 	}
 
+	secret, err := utils.NewSecret()
+	if err != nil {
+		return
+	}
+
 	folder, _ = filepath.Abs(folder)
 	folder = filepath.ToSlash(folder)
 
@@ -60,23 +142,36 @@ func New(domain, key, webocketURL, folder string) (c *client, err error) {
 	log.Infof("connecting to %s", webocketURL)
 	log.Infof("using domain '%s'", domain)
 	log.Infof("using key '%s'", key)
-	log.Infof("watching folder '%s'", folder)
 	publicURL := strings.Replace(webocketURL, "ws", "http", 1)
 	publicURL = strings.Replace(publicURL, "/ws", "/"+domain+"/", 1)
-	fmt.Printf("\n\t%s\n\n", publicURL)
 
 	c = &client{
 		WebsocketURL: webocketURL,
 		Domain:       domain,
 		Key:          key,
+		Secret:       secret,
 		Folder:       folder,
-		fileList:     make(map[string]struct{}),
+		publicURL:    publicURL,
+		fileList:     make(map[string]*indexEntry),
+		settling:     make(map[string]*time.Timer),
+		cancels:      make(map[int64]chan struct{}),
+		credits:      make(map[int64]chan int),
+		uploads:      make(map[int64]*upload),
 	}
 	return
 }
 
 func (c *client) Run() (err error) {
-	go c.watchFileSystem()
+	// the same files are watched across reconnects
+	if c.Proxy == "" {
+		c.watching.Do(func() {
+			c.mounted = c.mounts()
+			for _, m := range c.mounted {
+				log.Infof("serving folder '%s' at /%s", m.Folder, m.Prefix)
+				go c.watchFileSystem(m)
+			}
+		})
+	}
 
 	log.Debugf("dialing %s", c.WebsocketURL)
 	wsDial, _, err := websocket.DefaultDialer.Dial(c.WebsocketURL, nil)
@@ -89,15 +184,75 @@ func (c *client) Run() (err error) {
 	ws := wsconn.New(wsDial)
 
 	err = ws.Send(wsconn.Payload{
-		Type:    "domain",
-		Message: c.Domain,
-		Key:     c.Key,
+		Type:        "domain",
+		Message:     c.Domain,
+		Key:         c.Key,
+		Binary:      true,
+		Credit:      true,
+		Proxy:       c.Proxy != "",
+		Hostname:    c.Hostname,
+		Credentials: c.credentials(),
+		Secret:      c.Secret,
+		Links:       c.linkPaths(),
+		Upload:      c.Upload != "" && c.Proxy == "",
 	})
 	if err != nil {
 		log.Error(err)
 		return
 	}
 
+	// relays that don't know about binary frames won't echo it back
+	p, err := ws.Receive()
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+	log.Debugf("recv: %+v", p)
+	if p.Type == "domain" && !p.Success {
+		err = fmt.Errorf("could not host '%s': %s", c.Domain, p.Message)
+		log.Error(err)
+		return
+	}
+	// the relay knows best where it serves the domain
+	c.Lock()
+	if p.URL == "" {
+		p.URL = c.publicURL
+	}
+	if p.URL != c.printedURL {
+		fmt.Printf("\n\t%s\n\n", p.URL)
+		if len(c.Passwords) > 0 {
+			// the token lets visitors in without a password
+			fmt.Printf("\t%s?token=%s\n\n", p.URL, utils.SiteToken(c.Domain, c.Secret))
+			if u, errURL := url.Parse(p.URL); errURL == nil && u.Path != "/" {
+				log.Warnf("other sites on %s can read this one while visitors are logged in, use a relay with --subdomains or a --hostname to keep it apart", u.Host)
+			}
+		}
+		for _, link := range c.Links {
+			fmt.Printf("\t%s\n\n", c.signLink(p.URL, link))
+		}
+		c.printedURL = p.URL
+	}
+	c.binary = p.Binary
+	c.credit = p.Credit
+	c.ws = ws
+	c.Unlock()
+	defer func() {
+		// requests still being served stop with the connection,
+		// rather than waiting on it forever
+		c.Lock()
+		c.ws = nil
+		for id, cancel := range c.cancels {
+			close(cancel)
+			delete(c.cancels, id)
+			delete(c.credits, id)
+		}
+		// and so do uploads, whose chunks won't come anymore
+		for id := range c.uploads {
+			delete(c.uploads, id)
+		}
+		c.Unlock()
+	}()
+
 	for {
 		var p wsconn.Payload
 		p, err = ws.Receive()
@@ -107,129 +262,645 @@ func (c *client) Run() (err error) {
 		}
 		log.Debugf("recv: %+v", p)
 
-		if p.Type == "get" {
-			haveFile := false
+		if p.Type == "cancel" {
 			c.Lock()
-			_, haveFile = c.fileList[p.Message]
+			if cancel, ok := c.cancels[p.ID]; ok {
+				close(cancel)
+				delete(c.cancels, p.ID)
+			}
 			c.Unlock()
-			if !haveFile {
-				err = ws.Send(wsconn.Payload{
-					Type:    "get",
-					Success: false,
-					Message: "no such file",
-					Key:     c.Key,
-				})
-				log.Infof("%s /%s 404", p.IPAddress, p.Message)
+			continue
+		} else if p.Type == "credit" {
+			c.Lock()
+			if credits, ok := c.credits[p.ID]; ok {
+				select {
+				case credits <- p.Chunk:
+				default:
+				}
+			}
+			c.Unlock()
+			continue
+		} else if p.Type == "hostname" {
+			if p.Success {
+				fmt.Printf("\n\t%s\n\n", p.Message)
 			} else {
-				var b []byte
-
-				b, err = ioutil.ReadFile(path.Join(c.Folder, p.Message))
-				if err != nil {
-					log.Error(err)
-					return
+				log.Infof("%s", p.Message)
+				token := utils.VerificationToken(c.Domain, c.Key, p.Hostname)
+				log.Infof("to verify it, point %s at the relay with a CNAME record", p.Hostname)
+				log.Infof("or add a TXT record '_hostyoself.%s' with 'hostyoself-verification=%s'", p.Hostname, token)
+			}
+			continue
+		} else if p.Type == "chunk" {
+			// a piece of a file being uploaded
+			c.Lock()
+			u, ok := c.uploads[p.ID]
+			c.Unlock()
+			if ok {
+				select {
+				case u.ch <- p:
+				case <-u.done:
 				}
-				err = ws.Send(wsconn.Payload{
-					Type:    "get",
-					Success: true,
-					Message: dataurl.EncodeBytes(b),
-					Key:     c.Key,
-				})
-				log.Infof("%s /%s 200", p.IPAddress, p.Message)
 			}
-		} else if p.Type == "files" {
+			continue
+		}
+
+		// each request is served on its own so that a slow file
+		// doesn't hold up everyone else
+		cancel := make(chan struct{})
+		var u *upload
+		c.Lock()
+		c.cancels[p.ID] = cancel
+		if p.Type == "upload" {
+			// its chunks may arrive before it is served
+			u = &upload{
+				ch:   make(chan wsconn.Payload, uploadBuffer),
+				done: make(chan struct{}),
+			}
+			c.uploads[p.ID] = u
+		} else {
+			c.credits[p.ID] = make(chan int, wsconn.Window)
+		}
+		c.Unlock()
+		go func(p wsconn.Payload) {
+			var errServe error
+			if u != nil {
+				errServe = c.receiveUpload(ws, p, u, cancel)
+			} else {
+				errServe = c.serve(ws, p, cancel)
+			}
+			if errServe != nil {
+				log.Debug(errServe)
+			}
+			// the ID may be another request's once the
+			// connection is made again
 			c.Lock()
-			fs := make([]server.File, len(c.fileList))
-			i := 0
-			for n := range c.fileList {
-				fs[i] = server.File{
+			if c.cancels[p.ID] == cancel {
+				delete(c.cancels, p.ID)
+				delete(c.credits, p.ID)
+			}
+			c.Unlock()
+		}(p)
+	}
+}
+
+// serve responds to a single request from the relay
+func (c *client) serve(ws *wsconn.WebsocketConn, p wsconn.Payload, cancel <-chan struct{}) (err error) {
+	if p.Type == "get" && c.Hostname != "" && strings.TrimPrefix(p.Message, "/") == c.challenge() {
+		// the relay checks a custom hostname points at it by
+		// fetching this through the hostname
+		token := utils.VerificationToken(c.Domain, c.Key, c.Hostname)
+		err = ws.Send(wsconn.Payload{
+			ID:      p.ID,
+			Type:    "get",
+			Success: true,
+			Message: dataurl.New([]byte(token), "text/plain").String(),
+			Key:     c.Key,
+		})
+	} else if p.Type == "get" && c.Proxy != "" {
+		err = c.sendProxy(ws, p, cancel)
+	} else if p.Type == "get" {
+		haveFile, haveDir := false, false
+		c.Lock()
+		_, haveFile = c.fileList[p.Message]
+		_, haveDir = c.fileList[strings.TrimSuffix(p.Message, "/")+"/index.html"]
+		c.Unlock()
+		// ignored files stay hidden even if they are listed
+		haveFile = haveFile && !c.ignored(p.Message, false)
+		if p.Method != "" && p.Method != http.MethodGet && p.Method != http.MethodHead {
+			err = ws.Send(wsconn.Payload{
+				ID:      p.ID,
+				Type:    "get",
+				Success: false,
+				Status:  http.StatusMethodNotAllowed,
+				Message: "method not allowed",
+				Key:     c.Key,
+			})
+			log.Infof("%s%s %s /%s 405", c.Label, p.IPAddress, p.Method, p.Message)
+		} else if !haveFile && haveDir && !strings.HasSuffix(p.Message, "/") {
+			// folders are served from their index with a trailing slash
+			location := "/" + p.Message + "/"
+			if p.Query != "" {
+				location += "?" + p.Query
+			}
+			err = ws.Send(wsconn.Payload{
+				ID:      p.ID,
+				Type:    "get",
+				Success: true,
+				Status:  http.StatusMovedPermanently,
+				Header:  http.Header{"Location": []string{location}},
+				Key:     c.Key,
+			})
+			log.Infof("%s%s /%s 301", c.Label, p.IPAddress, p.Message)
+		} else if !haveFile {
+			err = ws.Send(wsconn.Payload{
+				ID:      p.ID,
+				Type:    "get",
+				Success: false,
+				Status:  http.StatusNotFound,
+				Message: "no such file",
+				Key:     c.Key,
+			})
+			log.Infof("%s%s /%s 404", c.Label, p.IPAddress, p.Message)
+		} else {
+			err = c.sendFile(ws, p, cancel)
+			if err == nil {
+				log.Infof("%s%s /%s 200", c.Label, p.IPAddress, p.Message)
+			}
+		}
+	} else if p.Type == "files" {
+		// files shared through links aren't listed
+		links := make(map[string]struct{})
+		for _, p := range c.linkPaths() {
+			links[p] = struct{}{}
+		}
+		c.Lock()
+		fs := make([]server.File, 0, len(c.fileList))
+		for n, e := range c.fileList {
+			if _, ok := links[n]; !ok {
+				fs = append(fs, server.File{
 					FullPath: n,
 					Upload: server.Upload{
 						UUID:     "",
 						Total:    0,
 						Filename: "",
 					},
+					Size:     e.Size,
+					Modified: e.Modified.Unix(),
+				})
+			}
+		}
+		c.Unlock()
+
+		// folders are listed along with the files in them
+		dirs := make(map[string]struct{})
+		for _, file := range fs {
+			n := file.FullPath
+			for dir := path.Dir(n); dir != "."; dir = path.Dir(dir) {
+				if _, ok := dirs[dir]; ok {
+					break
+				}
+				dirs[dir] = struct{}{}
+				f := server.File{FullPath: dir, IsDir: true}
+				if m, rel := c.mountFor(dir); m != nil {
+					if fi, errStat := os.Stat(m.file(rel)); errStat == nil {
+						f.Modified = fi.ModTime().Unix()
+					}
 				}
-				i++
+				fs = append(fs, f)
 			}
-			c.Unlock()
+		}
 
-			b, _ := json.Marshal(fs)
-			log.Infof("%s sitemap", p.IPAddress)
-			err = ws.Send(wsconn.Payload{
-				Type:    "files",
-				Success: true,
-				Message: string(b),
+		b, _ := json.Marshal(fs)
+		log.Infof("%s%s sitemap", c.Label, p.IPAddress)
+		err = ws.Send(wsconn.Payload{
+			ID:      p.ID,
+			Type:    "files",
+			Success: true,
+			Message: string(b),
+			Key:     c.Key,
+		})
+	}
+	return
+}
+
+// sendFile streams a file to the relay in chunks
+func (c *client) sendFile(ws *wsconn.WebsocketConn, p wsconn.Payload, cancel <-chan struct{}) (err error) {
+	file, err := c.resolve(p.Message)
+	if err != nil {
+		log.Debugf("refusing /%s: %s", p.Message, err.Error())
+		log.Infof("%s%s /%s 404", c.Label, p.IPAddress, p.Message)
+		return ws.Send(wsconn.Payload{
+			ID:      p.ID,
+			Type:    "get",
+			Success: false,
+			Status:  http.StatusNotFound,
+			Message: "no such file",
+			Key:     c.Key,
+		})
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		log.Error(err)
+		return ws.Send(wsconn.Payload{
+			ID:      p.ID,
+			Type:    "get",
+			Success: false,
+			Status:  http.StatusInternalServerError,
+			Message: "could not read file",
+			Key:     c.Key,
+		})
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	header := http.Header{
+		"Accept-Ranges": []string{"bytes"},
+	}
+	if c.uploaded(p.Message) {
+		// files from visitors are downloaded rather than shown,
+		// so that they can't act as pages of the site
+		header.Set("Content-Disposition", "attachment")
+		header.Set("X-Content-Type-Options", "nosniff")
+	}
+	etag := c.fileETag(p.Message, f, fi)
+
+	// only the headers are needed if the visitor has this version already
+	if p.Header != nil && utils.NotModified(p.Header, etag, fi.ModTime()) {
+		log.Infof("%s%s /%s 304", c.Label, p.IPAddress, p.Message)
+		return ws.Send(wsconn.Payload{
+			ID:       p.ID,
+			Type:     "get",
+			Success:  true,
+			Status:   http.StatusNotModified,
+			ETag:     etag,
+			Modified: fi.ModTime().Unix(),
+			Key:      c.Key,
+		})
+	}
+
+	status := http.StatusOK
+	size := fi.Size()
+	if p.Range != nil && rangeApplies(p.Range.IfRange, etag, fi) {
+		start, end, ok := p.Range.Resolve(fi.Size())
+		if !ok {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", fi.Size()))
+			log.Infof("%s%s /%s 416", c.Label, p.IPAddress, p.Message)
+			return ws.Send(wsconn.Payload{
+				ID:      p.ID,
+				Type:    "get",
+				Success: false,
+				Status:  http.StatusRequestedRangeNotSatisfiable,
+				Header:  header,
+				Message: "range not satisfiable",
 				Key:     c.Key,
 			})
 		}
+		_, err = f.Seek(start, io.SeekStart)
 		if err != nil {
-			log.Debug(err)
 			return
 		}
+		status = http.StatusPartialContent
+		size = end - start + 1
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fi.Size()))
+	}
 
+	// the body is left out when only the headers were asked for
+	var body io.Reader
+	if p.Method != http.MethodHead {
+		body = io.LimitReader(f, size)
 	}
+	return c.respond(ws, p, wsconn.Payload{
+		ID:          p.ID,
+		Type:        "get",
+		Success:     true,
+		Status:      status,
+		Header:      header,
+		ETag:        etag,
+		Modified:    fi.ModTime().Unix(),
+		Size:        size,
+		ContentType: mime.TypeByExtension(filepath.Ext(p.Message)),
+		Key:         c.Key,
+	}, body, cancel)
+}
 
-	return
+// respond sends the response to a request followed by its body, if
+// any, in chunks if the relay said it takes them in the handshake.
+// Older relays get the whole body at once as a data URL.
+func (c *client) respond(ws *wsconn.WebsocketConn, p, resp wsconn.Payload, body io.Reader, cancel <-chan struct{}) (err error) {
+	if body == nil {
+		return ws.Send(resp)
+	}
+	c.Lock()
+	chunked := c.binary || c.credit
+	c.Unlock()
+	if chunked {
+		resp.Chunked = true
+		err = ws.Send(resp)
+		if err != nil {
+			return
+		}
+		return c.sendBody(ws, p, body, cancel)
+	}
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		ws.Send(wsconn.Payload{
+			ID:      p.ID,
+			Type:    "get",
+			Success: false,
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+			Key:     c.Key,
+		})
+		return
+	}
+	resp.Message = dataurl.EncodeBytes(b)
+	return ws.Send(resp)
 }
 
-func (c *client) watchFileSystem() (err error) {
+// rangeApplies returns whether a range should be served given the
+// visitor's If-Range header, which must match the file's ETag or
+// modification time
+func rangeApplies(ifRange, etag string, fi os.FileInfo) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) {
+		return ifRange == etag
+	}
+	t, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	return !fi.ModTime().Truncate(time.Second).After(t)
+}
+
+// sendBody streams a response body to the relay in chunks until it
+// is read to the end or the request is cancelled, waiting for credit
+// if the relay grants it
+func (c *client) sendBody(ws *wsconn.WebsocketConn, p wsconn.Payload, r io.Reader, cancel <-chan struct{}) (err error) {
+	c.Lock()
+	binary := c.binary
+	credits := c.credits[p.ID]
+	if !c.credit {
+		credits = nil
+	}
+	c.Unlock()
+
+	buf := make([]byte, chunkSize)
+	avail := wsconn.Window
+	for chunk := 0; ; chunk++ {
+		if credits != nil && avail == 0 {
+			select {
+			case n := <-credits:
+				avail += n
+			case <-cancel:
+			}
+		}
+		select {
+		case <-cancel:
+			err = fmt.Errorf("request for /%s cancelled", p.Message)
+			return
+		default:
+		}
+
+		n, errRead := r.Read(buf)
+		done := errRead == io.EOF
+		if errRead != nil && !done {
+			ws.Send(wsconn.Payload{
+				ID:      p.ID,
+				Type:    "chunk",
+				Success: false,
+				Message: errRead.Error(),
+				Key:     c.Key,
+			})
+			return errRead
+		}
+		if n == 0 && !done {
+			chunk--
+			continue
+		}
+
+		chunkPayload := wsconn.Payload{
+			ID:      p.ID,
+			Type:    "chunk",
+			Success: true,
+			Chunk:   chunk,
+			Done:    done,
+			Key:     c.Key,
+		}
+		if binary {
+			chunkPayload.Data = buf[:n]
+			err = ws.SendBinary(chunkPayload)
+		} else {
+			if n > 0 {
+				chunkPayload.Message = dataurl.New(buf[:n], "application/octet-stream").String()
+			}
+			err = ws.Send(chunkPayload)
+		}
+		if err != nil || done {
+			return
+		}
+		avail--
+	}
+}
+
+// invalidate tells the relay that a file changed so that
+// it doesn't serve an old copy from its cache
+func (c *client) invalidate(p string) {
+	c.Lock()
+	ws := c.ws
+	c.Unlock()
+	if ws == nil {
+		return
+	}
+	err := ws.Send(wsconn.Payload{
+		Type:    "invalidate",
+		Message: p,
+		Key:     c.Key,
+	})
+	if err != nil {
+		log.Debug(err)
+	}
+}
+
+// watchFileSystem keeps fileList up to date with the files in the
+// folder of a mount, watching folders as they are created and
+// forgetting whole trees when they are removed or renamed
+func (c *client) watchFileSystem(m *mount) (err error) {
 	// creates a new file watcher
-	watcher, err := fsnotify.NewWatcher()
+	m.watcher, err = fsnotify.NewWatcher()
 	if err != nil {
+		log.Error(err)
 		return err
 	}
-	defer watcher.Close()
+	defer m.watcher.Close()
 
-	done := make(chan bool)
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-				log.Debugf("event: [%s] [%s]", event.Name, strings.ToLower(event.Op.String()))
-				c.Lock()
-				switch strings.ToLower(event.Op.String()) {
-				case "create":
-					c.fileList[filepath.ToSlash(event.Name)] = struct{}{}
-				case "remove":
-					delete(c.fileList, filepath.ToSlash(event.Name))
-				}
-				log.Debugf("map: %+v", c.fileList)
-				c.Unlock()
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				log.Error("error:", err)
+	err = c.addTree(m, filepath.FromSlash(m.Folder))
+	if err != nil {
+		log.Errorf("problem with '%s': %s", m.Folder, err.Error())
+		return
+	}
+
+	for {
+		select {
+		case event, ok := <-m.watcher.Events:
+			if !ok {
+				return
 			}
+			log.Debugf("event: [%s] [%s]", event.Name, strings.ToLower(event.Op.String()))
+			c.handleEvent(m, event)
+		case err, ok := <-m.watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Error("error:", err)
 		}
-	}()
+	}
+}
 
-	filepath.Walk(c.Folder, func(ppath string, fi os.FileInfo, err error) error {
+// handleEvent updates fileList for a change to a file or folder.
+// New folders are watched right away so that nothing created in them
+// is missed, and everything else is looked at once it settles.
+func (c *client) handleEvent(m *mount, event fsnotify.Event) {
+	rel, ok := m.relative(event.Name)
+	if !ok {
+		return
+	}
+	if event.Op&fsnotify.Create != 0 {
+		fi, err := os.Lstat(event.Name)
+		if err == nil && fi.IsDir() {
+			if c.ignored(m.path(rel), true) {
+				return
+			}
+			err = c.addTree(m, event.Name)
+			if err != nil {
+				log.Debugf("problem watching '%s': %s", event.Name, err.Error())
+			}
+			return
+		}
+	}
+	c.schedule(m, rel)
+}
+
+// addTree watches a folder of a mount and the folders in it, adding
+// their files. Folders mounted somewhere else in it are left to
+// their own mount.
+func (c *client) addTree(m *mount, root string) error {
+	fi, err := os.Lstat(root)
+	if err != nil {
+		return err
+	}
+	return c.addPath(m, root, fi)
+}
+
+// addPath adds a file of a mount, or watches a folder and then adds
+// what is in it, so that anything created in the folder meanwhile is
+// found by one or the other
+func (c *client) addPath(m *mount, ppath string, fi os.FileInfo) error {
+	rel, ok := m.relative(ppath)
+	if ok {
+		owner, _ := c.mountFor(m.path(rel))
+		if owner != m || c.ignored(m.path(rel), fi.IsDir()) {
+			return nil
+		}
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		// folders that are symlinks aren't walked
+		target, errStat := os.Stat(ppath)
+		if !c.FollowSymlinks || errStat != nil || target.IsDir() {
+			log.Debugf("skipping symlink %s", ppath)
+			return nil
+		}
+		fi = target
+	}
+	if fi.IsDir() {
+		log.Debugf("watching %s", ppath)
+		err := m.watcher.Add(ppath)
 		if err != nil {
-			log.Errorf("problem with '%s': %s", ppath, err.Error())
 			return err
 		}
-		ppath = filepath.ToSlash(ppath)
-		if strings.Contains(ppath, ".git") {
-			return nil
+		fis, err := ioutil.ReadDir(ppath)
+		if err != nil {
+			return err
 		}
-		if fi.Mode().IsDir() {
-			log.Debugf("watching %s", ppath)
-			return watcher.Add(ppath)
-		} else {
-			ppath, _ = filepath.Abs(ppath)
-			ppath = strings.TrimPrefix(filepath.ToSlash(ppath), c.Folder+"/")
-			log.Debugf("%s", ppath)
-			c.Lock()
-			c.fileList[ppath] = struct{}{}
-			c.Unlock()
+		for _, child := range fis {
+			name := filepath.Join(ppath, child.Name())
+			if err = c.addPath(m, name, child); err != nil {
+				log.Errorf("problem with '%s': %s", name, err.Error())
+			}
 		}
 		return nil
-	})
+	}
+	if !ok {
+		return nil
+	}
+	if c.index(m.path(rel), fi) {
+		log.Debugf("%s", m.path(rel))
+		c.invalidate(m.path(rel))
+	}
+	return nil
+}
+
+// removeTree forgets a file of a mount, or every file in a folder
+func (c *client) removeTree(m *mount, rel string) {
+	name := m.path(rel)
+	var removed []string
+	c.Lock()
+	for n := range c.fileList {
+		if n != name && !strings.HasPrefix(n, name+"/") {
+			continue
+		}
+		if owner, _ := c.mountFor(n); owner == m {
+			delete(c.fileList, n)
+			removed = append(removed, n)
+		}
+	}
+	c.Unlock()
+	for _, n := range removed {
+		c.invalidate(n)
+	}
+}
+
+// rescan forgets the files of a mount that are ignored now and adds
+// the ones that aren't anymore, after the ignore rules change
+func (c *client) rescan(m *mount) {
+	c.Lock()
+	names := make([]string, 0, len(c.fileList))
+	for n := range c.fileList {
+		names = append(names, n)
+	}
+	c.Unlock()
+	for _, n := range names {
+		if owner, rel := c.mountFor(n); owner == m && c.ignored(n, false) {
+			c.removeTree(m, rel)
+		}
+	}
+	err := c.addTree(m, filepath.FromSlash(m.Folder))
+	if err != nil {
+		log.Debugf("problem rescanning '%s': %s", m.Folder, err.Error())
+	}
+}
 
-	<-done
+// credentials hashes the passwords sent to the relay
+func (c *client) credentials() (credentials map[string]string) {
+	if len(c.Passwords) == 0 {
+		return
+	}
+	credentials = make(map[string]string)
+	for user, password := range c.Passwords {
+		credentials[user] = utils.PasswordHash(password)
+	}
 	return
 }
+
+// linkPaths returns the paths of the files only shared through links
+func (c *client) linkPaths() (paths []string) {
+	for _, link := range c.Links {
+		paths = append(paths, strings.TrimPrefix(path.Clean("/"+link.Path), "/"))
+	}
+	return
+}
+
+// signLink returns the URL of a file shared through a link
+func (c *client) signLink(siteURL string, link Link) string {
+	p := strings.TrimPrefix(path.Clean("/"+link.Path), "/")
+	var expires int64
+	if !link.Expires.IsZero() {
+		expires = link.Expires.Unix()
+	}
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("downloads", strconv.Itoa(link.Downloads))
+	q.Set("signature", utils.SignLink(c.Domain, c.Secret, p, expires, link.Downloads))
+	return siteURL + p + "?" + q.Encode()
+}
+
+// challenge returns the path of the file that proves the custom
+// hostname belongs to this host
+func (c *client) challenge() string {
+	return ".well-known/hostyoself/" + utils.VerificationToken(c.Domain, c.Key, c.Hostname)
+}
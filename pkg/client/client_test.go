@@ -0,0 +1,407 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gorilla/websocket"
+	"github.com/schollz/hostyoself/pkg/wsconn"
+	"github.com/vincent-petithory/dataurl"
+)
+
+// files is what fileList should hold, as sizes by path of the site
+type files map[string]int64
+
+// testClient returns a client serving dir, at prefix if it is set
+func testClient(t testing.TB, dir, prefix string) *client {
+	c, err := New("test", "key", "http://localhost", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix != "" {
+		m, err := NewMount(prefix, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Folder = ""
+		c.Mounts = []Mount{m}
+	}
+	c.mounted = c.mounts()
+	return c
+}
+
+// write creates a file and the folders it is in
+func write(t testing.TB, name, data string) {
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(name, []byte(data), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor waits for fileList to hold exactly the files wanted
+func waitFor(t *testing.T, c *client, want files) {
+	var got files
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		got = make(files)
+		c.Lock()
+		for name, e := range c.fileList {
+			got[name] = e.Size
+		}
+		c.Unlock()
+		if len(got) == len(want) {
+			same := true
+			for name, size := range want {
+				if s, ok := got[name]; !ok || s != size {
+					same = false
+				}
+			}
+			if same {
+				return
+			}
+		}
+	}
+	t.Fatalf("got %v, want %v", got, want)
+}
+
+func TestWatchFileSystem(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		// setup is there before the folder is watched, and change
+		// is made while it is
+		setup  []string
+		change func(t *testing.T, dir string)
+		before files
+		after  files
+	}{
+		{
+			name:  "nested folder created after startup",
+			setup: []string{"keep.txt"},
+			change: func(t *testing.T, dir string) {
+				write(t, filepath.Join(dir, "a", "b", "c", "new.txt"), "hello")
+			},
+			before: files{"keep.txt": 8},
+			after:  files{"keep.txt": 8, "a/b/c/new.txt": 5},
+		},
+		{
+			name:  "tree renamed",
+			setup: []string{"keep.txt", "src/x.txt", "src/sub/y.txt"},
+			change: func(t *testing.T, dir string) {
+				err := os.Rename(filepath.Join(dir, "src"), filepath.Join(dir, "dst"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			before: files{"keep.txt": 8, "src/x.txt": 9, "src/sub/y.txt": 13},
+			after:  files{"keep.txt": 8, "dst/x.txt": 9, "dst/sub/y.txt": 13},
+		},
+		{
+			name:  "tree removed",
+			setup: []string{"keep.txt", "gone/x.txt", "gone/sub/y.txt"},
+			change: func(t *testing.T, dir string) {
+				err := os.RemoveAll(filepath.Join(dir, "gone"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			before: files{"keep.txt": 8, "gone/x.txt": 10, "gone/sub/y.txt": 14},
+			after:  files{"keep.txt": 8},
+		},
+		{
+			name:  "file created then written",
+			setup: []string{"keep.txt"},
+			change: func(t *testing.T, dir string) {
+				f, err := os.Create(filepath.Join(dir, "grow.txt"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				for i := 0; i < 3; i++ {
+					f.WriteString("more")
+					time.Sleep(10 * time.Millisecond)
+				}
+			},
+			before: files{"keep.txt": 8},
+			after:  files{"keep.txt": 8, "grow.txt": 12},
+		},
+		{
+			name:   "paths relative to the mount",
+			prefix: "/docs/",
+			setup:  []string{"keep.txt"},
+			change: func(t *testing.T, dir string) {
+				write(t, filepath.Join(dir, "sub", "new.txt"), "hello")
+			},
+			before: files{"docs/keep.txt": 8},
+			after:  files{"docs/keep.txt": 8, "docs/sub/new.txt": 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.setup {
+				write(t, filepath.Join(dir, filepath.FromSlash(name)), name)
+			}
+			c := testClient(t, dir, tt.prefix)
+			m := c.mounted[0]
+			go c.watchFileSystem(m)
+			waitFor(t, c, tt.before)
+			// the folders are watched once their files are indexed
+			defer m.watcher.Close()
+
+			tt.change(t, dir)
+			waitFor(t, c, tt.after)
+		})
+	}
+}
+
+func TestHandleEvent(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup []string
+		// event is for a path in the folder unless it is absolute
+		event string
+		op    fsnotify.Op
+		want  files
+	}{
+		{
+			name:  "file created and written",
+			setup: []string{"a.txt"},
+			event: "a.txt",
+			op:    fsnotify.Create | fsnotify.Write,
+			want:  files{"a.txt": 5},
+		},
+		{
+			name:  "folder created and written",
+			setup: []string{"new/sub/b.txt"},
+			event: "new",
+			op:    fsnotify.Create | fsnotify.Write,
+			want:  files{"new/sub/b.txt": 13},
+		},
+		{
+			name:  "ignored folder created",
+			setup: []string{".git/config"},
+			event: ".git",
+			op:    fsnotify.Create,
+			want:  files{},
+		},
+		{
+			name:  "outside the folder",
+			event: os.TempDir(),
+			op:    fsnotify.Create | fsnotify.Write,
+			want:  files{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.setup {
+				write(t, filepath.Join(dir, filepath.FromSlash(name)), name)
+			}
+			c := testClient(t, dir, "")
+			m := c.mounted[0]
+			var err error
+			m.watcher, err = fsnotify.NewWatcher()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.watcher.Close()
+
+			name := tt.event
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(dir, filepath.FromSlash(name))
+			}
+			c.handleEvent(m, fsnotify.Event{Name: name, Op: tt.op})
+			time.Sleep(2 * settleTime)
+			waitFor(t, c, tt.want)
+		})
+	}
+}
+
+// testRelay plays a relay for a client, answering its handshake with
+// the binary and credit flags and then handing the connection to relay
+func testRelay(t *testing.T, c *client, binary, credit bool, relay func(ws *wsconn.WebsocketConn)) {
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ws := wsconn.New(conn)
+		p, err := ws.Receive()
+		if err != nil {
+			return
+		}
+		err = ws.Send(wsconn.Payload{
+			Type:    "domain",
+			Success: true,
+			Message: p.Message,
+			Binary:  binary && p.Binary,
+			Credit:  credit && p.Credit,
+			URL:     "http://localhost/test/",
+		})
+		if err != nil {
+			return
+		}
+		relay(ws)
+	}))
+	t.Cleanup(ts.Close)
+	c.WebsocketURL = "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+}
+
+func TestRespond(t *testing.T) {
+	tests := []struct {
+		name        string
+		binary      bool
+		credit      bool
+		wantChunked bool
+		wantDataURL bool
+	}{
+		{name: "old relay", wantDataURL: true},
+		{name: "binary", binary: true, wantChunked: true},
+		{name: "credit", credit: true, wantChunked: true},
+		{name: "binary and credit", binary: true, credit: true, wantChunked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			write(t, filepath.Join(dir, "index.html"), "hello")
+			c := testClient(t, dir, "")
+			c.fileList["index.html"] = &indexEntry{Size: 5}
+			got := make(chan wsconn.Payload, 8)
+			testRelay(t, c, tt.binary, tt.credit, func(ws *wsconn.WebsocketConn) {
+				ws.Send(wsconn.Payload{ID: 1, Type: "get", Message: "index.html"})
+				for {
+					p, err := ws.Receive()
+					if err != nil {
+						return
+					}
+					got <- p
+					if !p.Chunked || p.Done {
+						return
+					}
+				}
+			})
+			go c.Run()
+
+			p := <-got
+			if p.Chunked != tt.wantChunked {
+				t.Fatalf("chunked is %v, want %v", p.Chunked, tt.wantChunked)
+			}
+			var body []byte
+			if tt.wantDataURL {
+				dataURL, err := dataurl.DecodeString(p.Message)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = dataURL.Data
+			} else {
+				chunk := <-got
+				body = chunk.Data
+				if !tt.binary {
+					dataURL, err := dataurl.DecodeString(chunk.Message)
+					if err != nil {
+						t.Fatal(err)
+					}
+					body = dataURL.Data
+				}
+			}
+			if string(body) != "hello" {
+				t.Errorf("got %q, want %q", body, "hello")
+			}
+		})
+	}
+}
+
+func TestRunStopsRequests(t *testing.T) {
+	// the file is more than the relay lets the host send
+	// without credit, which it never grants
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "big.bin"), strings.Repeat("x", 2*wsconn.Window*chunkSize))
+	c := testClient(t, dir, "")
+	c.fileList["big.bin"] = &indexEntry{Size: 2 * wsconn.Window * chunkSize}
+	testRelay(t, c, true, true, func(ws *wsconn.WebsocketConn) {
+		ws.Send(wsconn.Payload{ID: 1, Type: "get", Message: "big.bin"})
+		for chunks := 0; chunks < wsconn.Window; {
+			p, err := ws.Receive()
+			if err != nil {
+				return
+			}
+			if p.Type == "chunk" {
+				chunks++
+			}
+		}
+	})
+
+	err := c.Run()
+	if err == nil {
+		t.Fatal("Run should return the error that closed the connection")
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		c.Lock()
+		serving := len(c.cancels) + len(c.credits)
+		c.Unlock()
+		if serving == 0 {
+			return
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("%d requests still being served", serving)
+		}
+	}
+}
+
+func TestProxyPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxy   string
+		message string
+		want    string
+	}{
+		{name: "plain", message: "a/b", want: "/a/b"},
+		{name: "question mark", message: "a%3Fb", want: "/a%3Fb"},
+		{name: "hash", message: "a%23b", want: "/a%23b"},
+		{name: "slash", message: "a%2Fb", want: "/a%2Fb"},
+		{name: "space", message: "a%20b", want: "/a%20b"},
+		{name: "under a path", proxy: "/app/", message: "a%2Fb", want: "/app/a%2Fb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make(chan string, 1)
+			local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got <- r.URL.EscapedPath()
+			}))
+			defer local.Close()
+
+			c := testClient(t, t.TempDir(), "")
+			c.Proxy = local.URL + tt.proxy
+			testRelay(t, c, true, true, func(ws *wsconn.WebsocketConn) {
+				ws.Send(wsconn.Payload{ID: 1, Type: "get", Message: tt.message})
+				for {
+					if _, err := ws.Receive(); err != nil {
+						return
+					}
+				}
+			})
+			go c.Run()
+
+			select {
+			case path := <-got:
+				if path != tt.want {
+					t.Errorf("got %s, want %s", path, tt.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the request never reached the local server")
+			}
+		})
+	}
+}
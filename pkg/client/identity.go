@@ -0,0 +1,123 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Identity is the domain and key a folder is hosted with, saved so
+// that restarting keeps the same URL. Saved by domain, it holds the
+// secret that keeps the tokens and links of the domain working.
+type Identity struct {
+	Domain string `json:"domain"`
+	Key    string `json:"key"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// configFile returns the path of a file in the config folder
+func configFile(name string) (file string, err error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		var home string
+		home, err = os.UserHomeDir()
+		if err != nil {
+			return
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "hostyoself", name), nil
+}
+
+// readIdentities returns every identity saved in a file of the config
+// folder, identities.json by folder or secrets.json by domain
+func readIdentities(name string) (ids map[string]Identity, file string, err error) {
+	ids = make(map[string]Identity)
+	file, err = configFile(name)
+	if err != nil {
+		return
+	}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return ids, file, nil
+	} else if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &ids)
+	return
+}
+
+// LoadIdentity returns the identity saved for a folder, if any
+func LoadIdentity(folder string) (id Identity, ok bool) {
+	ids, _, err := readIdentities("identities.json")
+	if err != nil {
+		return
+	}
+	id, ok = ids[folder]
+	return
+}
+
+// SaveIdentity saves the identity of a folder for the next time it
+// is hosted
+func SaveIdentity(folder string, id Identity) (err error) {
+	return saveIdentity("identities.json", folder, id)
+}
+
+// LoadSecret returns the secret saved for a domain hosted with a key,
+// if any
+func LoadSecret(domain, key string) (secret string, ok bool) {
+	ids, _, err := readIdentities("secrets.json")
+	if err != nil {
+		return
+	}
+	id, ok := ids[domain]
+	if !ok || id.Key != key || id.Secret == "" {
+		return "", false
+	}
+	return id.Secret, true
+}
+
+// SaveSecret saves the secret of a domain hosted with a key, which
+// it keeps however the domain is hosted next time
+func SaveSecret(domain, key, secret string) (err error) {
+	return saveIdentity("secrets.json", domain, Identity{Domain: domain, Key: key, Secret: secret})
+}
+
+// saveIdentity saves an identity by name in a file of the config folder
+func saveIdentity(name, by string, id Identity) (err error) {
+	ids, file, err := readIdentities(name)
+	if err != nil && file == "" {
+		return
+	}
+	// a broken file is replaced
+	if ids == nil {
+		ids = make(map[string]Identity)
+	}
+	ids[by] = id
+	b, err := json.MarshalIndent(ids, "", "  ")
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return
+	}
+	// the keys are secrets, and other hosts may be saving theirs
+	tmp, err := ioutil.TempFile(filepath.Dir(file), strings.TrimSuffix(filepath.Base(file), ".json"))
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(b)
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return
+}
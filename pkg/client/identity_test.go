@@ -0,0 +1,46 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestSecret(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	if _, ok := LoadSecret("site", "key"); ok {
+		t.Fatal("got a secret before one was saved")
+	}
+	if err := SaveSecret("site", "key", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	// secrets are kept apart from the identities of folders
+	if err := SaveIdentity("/some/folder", Identity{Domain: "site", Key: "key"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveSecret("other", "key", "other secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		domain string
+		key    string
+		want   string
+	}{
+		{domain: "site", key: "key", want: "secret"},
+		{domain: "other", key: "key", want: "other secret"},
+		// a domain taken up with another key gets another secret
+		{domain: "site", key: "otherkey"},
+		{domain: "unknown", key: "key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain+"/"+tt.key, func(t *testing.T) {
+			got, ok := LoadSecret(tt.domain, tt.key)
+			if ok != (tt.want != "") || got != tt.want {
+				t.Errorf("got %q, %v, want %q", got, ok, tt.want)
+			}
+		})
+	}
+	if id, ok := LoadIdentity("/some/folder"); !ok || id.Secret != "" {
+		t.Errorf("got identity %+v, %v", id, ok)
+	}
+}
@@ -0,0 +1,192 @@
+package client
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ignoreFiles are read for rules in every folder, like .gitignore
+var ignoreFiles = []string{".gitignore", ".hostyoselfignore"}
+
+// defaultIgnore keeps version control and secrets out of every site,
+// which can be undone with --include
+var defaultIgnore = []string{".git/", ".hg/", ".svn/", ".env", ".env.*", "id_rsa", "id_dsa", "id_ecdsa", "id_ed25519", "*.pem", "*.key"}
+
+// isIgnoreFile returns whether a path is one of the ignore files
+func isIgnoreFile(rel string) bool {
+	for _, name := range ignoreFiles {
+		if path.Base(rel) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// rule is a single gitignore pattern
+type rule struct {
+	pattern string
+	// base is the folder of the file the rule is from
+	base     string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// parseRules reads gitignore lines from a file in the folder base
+func parseRules(lines []string, base string) (rules []rule) {
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r := rule{base: base}
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		// patterns with a slash are relative to their file's
+		// folder, others match a name anywhere below it
+		r.anchored = strings.Contains(line, "/")
+		r.pattern = strings.TrimPrefix(line, "/")
+		if r.pattern != "" {
+			rules = append(rules, r)
+		}
+	}
+	return
+}
+
+// matches returns whether the rule matches a path relative to Folder
+func (r rule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = strings.TrimPrefix(rel, r.base+"/")
+	}
+	if !r.anchored {
+		ok, _ := path.Match(r.pattern, path.Base(rel))
+		return ok
+	}
+	return matchSegments(strings.Split(r.pattern, "/"), strings.Split(rel, "/"))
+}
+
+// matchSegments matches a path against a pattern one folder at a
+// time, where ** matches any number of folders
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], segments[0])
+	return ok && matchSegments(pattern[1:], segments[1:])
+}
+
+// ignorer decides which files in a folder are kept out of the site,
+// following the ignore files in it and the rules given on the command line
+type ignorer struct {
+	folder   string
+	defaults []rule
+	flags    []rule
+	// files holds the rules of the ignore files by folder,
+	// read the first time they are needed
+	files map[string][]rule
+	sync.Mutex
+}
+
+// newIgnorer returns an ignorer for a folder with extra patterns to
+// exclude and to include even if something else excludes them
+func newIgnorer(folder string, exclude, include []string) *ignorer {
+	ig := &ignorer{
+		folder:   folder,
+		defaults: parseRules(defaultIgnore, ""),
+		flags:    parseRules(exclude, ""),
+		files:    make(map[string][]rule),
+	}
+	for _, pattern := range include {
+		ig.flags = append(ig.flags, parseRules([]string{"!" + pattern}, "")...)
+	}
+	return ig
+}
+
+// reset forgets the rules read from ignore files after one changes
+func (ig *ignorer) reset() {
+	ig.Lock()
+	ig.files = make(map[string][]rule)
+	ig.Unlock()
+}
+
+// rules returns the rules of the ignore files in a folder
+func (ig *ignorer) rules(dir string) []rule {
+	ig.Lock()
+	defer ig.Unlock()
+	if rules, ok := ig.files[dir]; ok {
+		return rules
+	}
+	var rules []rule
+	for _, name := range ignoreFiles {
+		b, err := ioutil.ReadFile(filepath.Join(filepath.FromSlash(ig.folder), filepath.FromSlash(dir), name))
+		if err == nil {
+			rules = append(rules, parseRules(strings.Split(string(b), "\n"), dir)...)
+		}
+	}
+	ig.files[dir] = rules
+	return rules
+}
+
+// ignored returns whether a path relative to the folder is kept out
+// of the site, which it is if any folder it is in is
+func (ig *ignorer) ignored(rel string, isDir bool) bool {
+	if ig == nil {
+		return false
+	}
+	segments := strings.Split(rel, "/")
+	for i := 1; i < len(segments); i++ {
+		if ig.match(strings.Join(segments[:i], "/"), true) {
+			return true
+		}
+	}
+	return ig.match(rel, isDir)
+}
+
+// match applies the rules for a path, where the last one that
+// matches wins. Rules in deeper folders come later, and the command
+// line comes last.
+func (ig *ignorer) match(rel string, isDir bool) (ignored bool) {
+	apply := func(rules []rule) {
+		for _, r := range rules {
+			if r.matches(rel, isDir) {
+				ignored = !r.negate
+			}
+		}
+	}
+	apply(ig.defaults)
+	apply(ig.rules(""))
+	segments := strings.Split(rel, "/")
+	for i := 1; i < len(segments); i++ {
+		apply(ig.rules(strings.Join(segments[:i], "/")))
+	}
+	apply(ig.flags)
+	return
+}
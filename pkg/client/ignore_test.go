@@ -0,0 +1,281 @@
+package client
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnored(t *testing.T) {
+	tests := []struct {
+		name string
+		// ignoreFiles are written into the folder by path
+		ignoreFiles map[string]string
+		exclude     []string
+		include     []string
+		path        string
+		isDir       bool
+		want        bool
+	}{
+		{name: "plain file", path: "index.html", want: false},
+
+		// the default secret list
+		{name: "git folder", path: ".git", isDir: true, want: true},
+		{name: "file in git folder", path: ".git/config", want: true},
+		{name: "nested git folder", path: "vendor/lib/.git/HEAD", want: true},
+		{name: "hg folder", path: ".hg/store", want: true},
+		{name: "svn folder", path: ".svn/entries", want: true},
+		{name: "git file", path: ".git", want: false},
+		{name: "env file", path: ".env", want: true},
+		{name: "env variant", path: "app/.env.production", want: true},
+		{name: "environment file", path: "environment.txt", want: false},
+		{name: "ssh key", path: "home/id_rsa", want: true},
+		{name: "ssh public key", path: "home/id_rsa.pub", want: false},
+		{name: "ed25519 key", path: "id_ed25519", want: true},
+		{name: "pem file", path: "certs/server.pem", want: true},
+		{name: "key file", path: "server.key", want: true},
+		{name: "keynote file", path: "slides.keynote", want: false},
+
+		// --include and --exclude
+		{name: "included secret", include: []string{"public.pem"}, path: "public.pem", want: false},
+		{name: "included secret elsewhere", include: []string{"public.pem"}, path: "certs/public.pem", want: false},
+		{name: "other secrets stay", include: []string{"public.pem"}, path: "private.pem", want: true},
+		{name: "included folder", include: []string{".git/"}, path: ".git/config", want: false},
+		{name: "excluded", exclude: []string{"*.log"}, path: "logs/app.log", want: true},
+		{name: "excluded folder", exclude: []string{"drafts/"}, path: "drafts/post.md", want: true},
+		{name: "exclude then include", exclude: []string{"*.log"}, include: []string{"keep.log"}, path: "keep.log", want: false},
+		{
+			name:        "include beats ignore file",
+			ignoreFiles: map[string]string{".gitignore": "*.txt"},
+			include:     []string{"notes.txt"},
+			path:        "notes.txt",
+			want:        false,
+		},
+		{
+			name:        "exclude beats ignore file",
+			ignoreFiles: map[string]string{".gitignore": "*.txt\n!notes.txt"},
+			exclude:     []string{"notes.txt"},
+			path:        "notes.txt",
+			want:        true,
+		},
+
+		// negation is read in order, and the last rule that matches wins
+		{
+			name:        "negated",
+			ignoreFiles: map[string]string{".gitignore": "*.txt\n!keep.txt"},
+			path:        "keep.txt",
+			want:        false,
+		},
+		{
+			name:        "negation before the rule",
+			ignoreFiles: map[string]string{".gitignore": "!keep.txt\n*.txt"},
+			path:        "keep.txt",
+			want:        true,
+		},
+		{
+			name:        "negation undone",
+			ignoreFiles: map[string]string{".gitignore": "*.txt\n!keep.txt\nkeep.txt"},
+			path:        "keep.txt",
+			want:        true,
+		},
+		{
+			name:        "negated in an ignored folder",
+			ignoreFiles: map[string]string{".gitignore": "build/\n!build/keep.txt"},
+			path:        "build/keep.txt",
+			want:        true,
+		},
+		{
+			name:        "escaped bang",
+			ignoreFiles: map[string]string{".gitignore": `\!important.txt`},
+			path:        "!important.txt",
+			want:        true,
+		},
+		{
+			name:        "comments and blank lines",
+			ignoreFiles: map[string]string{".gitignore": "# notes.txt\n\n   \nother.txt"},
+			path:        "notes.txt",
+			want:        false,
+		},
+		{
+			name:        "trailing spaces",
+			ignoreFiles: map[string]string{".gitignore": "notes.txt  \r"},
+			path:        "notes.txt",
+			want:        true,
+		},
+
+		// anchoring
+		{
+			name:        "name anywhere",
+			ignoreFiles: map[string]string{".gitignore": "build"},
+			path:        "src/build/out.js",
+			want:        true,
+		},
+		{
+			name:        "anchored at the root",
+			ignoreFiles: map[string]string{".gitignore": "/build"},
+			path:        "build/out.js",
+			want:        true,
+		},
+		{
+			name:        "anchored not below",
+			ignoreFiles: map[string]string{".gitignore": "/build"},
+			path:        "src/build/out.js",
+			want:        false,
+		},
+		{
+			name:        "slash in the middle anchors",
+			ignoreFiles: map[string]string{".gitignore": "docs/*.md"},
+			path:        "docs/readme.md",
+			want:        true,
+		},
+		{
+			name:        "slash in the middle not below",
+			ignoreFiles: map[string]string{".gitignore": "docs/*.md"},
+			path:        "src/docs/readme.md",
+			want:        false,
+		},
+		{
+			name:        "star stays in its folder",
+			ignoreFiles: map[string]string{".gitignore": "docs/*.md"},
+			path:        "docs/sub/readme.md",
+			want:        false,
+		},
+
+		// **
+		{
+			name:        "leading double star",
+			ignoreFiles: map[string]string{".gitignore": "**/temp"},
+			path:        "a/b/temp",
+			want:        true,
+		},
+		{
+			name:        "leading double star at the root",
+			ignoreFiles: map[string]string{".gitignore": "**/temp"},
+			path:        "temp",
+			want:        true,
+		},
+		{
+			name:        "middle double star",
+			ignoreFiles: map[string]string{".gitignore": "a/**/b.txt"},
+			path:        "a/x/y/b.txt",
+			want:        true,
+		},
+		{
+			name:        "middle double star matching no folders",
+			ignoreFiles: map[string]string{".gitignore": "a/**/b.txt"},
+			path:        "a/b.txt",
+			want:        true,
+		},
+		{
+			name:        "middle double star elsewhere",
+			ignoreFiles: map[string]string{".gitignore": "a/**/b.txt"},
+			path:        "c/x/b.txt",
+			want:        false,
+		},
+		{
+			name:        "trailing double star",
+			ignoreFiles: map[string]string{".gitignore": "cache/**"},
+			path:        "cache/x/y.bin",
+			want:        true,
+		},
+
+		// dir-only rules
+		{
+			name:        "dir-only on a folder",
+			ignoreFiles: map[string]string{".gitignore": "logs/"},
+			path:        "logs",
+			isDir:       true,
+			want:        true,
+		},
+		{
+			name:        "dir-only in a folder",
+			ignoreFiles: map[string]string{".gitignore": "logs/"},
+			path:        "app/logs/today.txt",
+			want:        true,
+		},
+		{
+			name:        "dir-only on a file",
+			ignoreFiles: map[string]string{".gitignore": "logs/"},
+			path:        "logs",
+			want:        false,
+		},
+
+		// nested ignore files
+		{
+			name:        "nested rule in its folder",
+			ignoreFiles: map[string]string{"sub/.gitignore": "*.txt"},
+			path:        "sub/notes.txt",
+			want:        true,
+		},
+		{
+			name:        "nested rule below its folder",
+			ignoreFiles: map[string]string{"sub/.gitignore": "*.txt"},
+			path:        "sub/deeper/notes.txt",
+			want:        true,
+		},
+		{
+			name:        "nested rule outside its folder",
+			ignoreFiles: map[string]string{"sub/.gitignore": "*.txt"},
+			path:        "notes.txt",
+			want:        false,
+		},
+		{
+			name:        "nested anchored rule",
+			ignoreFiles: map[string]string{"sub/.gitignore": "/notes.txt"},
+			path:        "sub/deeper/notes.txt",
+			want:        false,
+		},
+		{
+			name:        "nested negation wins over the root",
+			ignoreFiles: map[string]string{".gitignore": "*.txt", "sub/.gitignore": "!keep.txt"},
+			path:        "sub/keep.txt",
+			want:        false,
+		},
+		{
+			name:        "root negation loses to nested",
+			ignoreFiles: map[string]string{".gitignore": "!keep.txt", "sub/.gitignore": "*.txt"},
+			path:        "sub/keep.txt",
+			want:        true,
+		},
+		{
+			name:        "hostyoselfignore",
+			ignoreFiles: map[string]string{".hostyoselfignore": "private/"},
+			path:        "private/diary.txt",
+			want:        true,
+		},
+		{
+			name:        "hostyoselfignore after gitignore",
+			ignoreFiles: map[string]string{".gitignore": "*.txt", ".hostyoselfignore": "!notes.txt"},
+			path:        "notes.txt",
+			want:        false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range tt.ignoreFiles {
+				write(t, filepath.Join(dir, filepath.FromSlash(name)), data)
+			}
+			ig := newIgnorer(dir, tt.exclude, tt.include)
+			if got := ig.ignored(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnorerReset(t *testing.T) {
+	dir := t.TempDir()
+	ig := newIgnorer(dir, nil, nil)
+	if ig.ignored("notes.txt", false) {
+		t.Fatal("ignored before there are any rules")
+	}
+	// rules are read once, until the ignorer is told they changed
+	write(t, filepath.Join(dir, ".gitignore"), "*.txt")
+	if ig.ignored("notes.txt", false) {
+		t.Error("rules read again before reset")
+	}
+	ig.reset()
+	if !ig.ignored("notes.txt", false) {
+		t.Error("new rules not read after reset")
+	}
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/schollz/logger"
+)
+
+// settleTime is how long a file must go without changes before it is
+// looked at again, as editors write, rename and chmod in bursts
+const settleTime = 100 * time.Millisecond
+
+// hashLimit is the largest file that is hashed for its ETag, bigger
+// ones are identified by their modification time and size
+const hashLimit = 32 * 1024 * 1024
+
+// indexEntry is what is known about a file of the site
+type indexEntry struct {
+	Size     int64
+	Modified time.Time
+	Mode     os.FileMode
+	// Hash is of the contents, worked out the first time the
+	// file is served and forgotten when it changes
+	Hash string
+}
+
+// index adds a file to fileList or updates it, returning whether it
+// is new or changed since it was last seen
+func (c *client) index(rel string, fi os.FileInfo) (changed bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.fileList[rel]
+	if ok && e.Size == fi.Size() && e.Modified.Equal(fi.ModTime()) {
+		changed = e.Mode != fi.Mode()
+		e.Mode = fi.Mode()
+		return
+	}
+	c.fileList[rel] = &indexEntry{
+		Size:     fi.Size(),
+		Modified: fi.ModTime(),
+		Mode:     fi.Mode(),
+	}
+	return true
+}
+
+// schedule looks at a path of a mount again once it settles,
+// putting off any look already scheduled for it
+func (c *client) schedule(m *mount, rel string) {
+	name := m.path(rel)
+	c.Lock()
+	defer c.Unlock()
+	if t, ok := c.settling[name]; ok {
+		t.Stop()
+	}
+	c.settling[name] = time.AfterFunc(settleTime, func() {
+		c.Lock()
+		delete(c.settling, name)
+		c.Unlock()
+		c.refresh(m, rel)
+	})
+}
+
+// refresh brings fileList up to date with a path of a mount after it
+// changed, whether it was written, renamed, removed or had its mode
+// changed
+func (c *client) refresh(m *mount, rel string) {
+	if isIgnoreFile(rel) {
+		// what is ignored may have changed
+		m.ignore.reset()
+		c.rescan(m)
+	}
+
+	name := m.path(rel)
+	if owner, _ := c.mountFor(name); owner != m {
+		// something else is mounted here
+		return
+	}
+	fi, err := os.Lstat(m.file(rel))
+	if err != nil {
+		// removed, or renamed to somewhere else
+		c.removeTree(m, rel)
+		return
+	}
+	if fi.IsDir() {
+		// new folders are watched as they are created, and one
+		// that is still there is one whose watch moved to its
+		// new name after being renamed
+		return
+	}
+	if c.ignored(name, false) {
+		c.removeTree(m, rel)
+		return
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, errStat := os.Stat(m.file(rel))
+		if !c.FollowSymlinks || errStat != nil || target.IsDir() {
+			c.removeTree(m, rel)
+			return
+		}
+		fi = target
+	}
+	if c.index(name, fi) {
+		log.Debugf("%s changed", name)
+		c.invalidate(name)
+	}
+}
+
+// fileETag identifies a version of a file by a hash of it, kept in
+// the index until the file changes. Big files, and files that can't
+// be read, are identified by their modification time and size.
+func (c *client) fileETag(rel string, f *os.File, fi os.FileInfo) string {
+	if fi.Size() > hashLimit {
+		return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+	}
+	c.Lock()
+	e, ok := c.fileList[rel]
+	if ok && e.Hash != "" && e.Size == fi.Size() && e.Modified.Equal(fi.ModTime()) {
+		hash := e.Hash
+		c.Unlock()
+		return `"` + hash + `"`
+	}
+	c.Unlock()
+
+	h := sha256.New()
+	// reading at offsets leaves the file where it is to be served
+	_, err := io.Copy(h, io.NewSectionReader(f, 0, fi.Size()))
+	if err != nil {
+		log.Debugf("problem hashing /%s: %s", rel, err.Error())
+		return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+	}
+	hash := hex.EncodeToString(h.Sum(nil)[:16])
+
+	c.Lock()
+	if e, ok := c.fileList[rel]; ok {
+		e.Size = fi.Size()
+		e.Modified = fi.ModTime()
+		e.Hash = hash
+	}
+	c.Unlock()
+	return `"` + hash + `"`
+}
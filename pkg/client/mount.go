@@ -0,0 +1,126 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Mount serves a folder under a path of the site
+type Mount struct {
+	// Prefix is the path without slashes around it, which is
+	// empty for the root of the site
+	Prefix string
+	Folder string
+}
+
+// NewMount returns a mount of a folder at a path of the site
+func NewMount(prefix, folder string) (m Mount, err error) {
+	m.Prefix = strings.Trim(path.Clean("/"+filepath.ToSlash(prefix)), "/")
+	folder, err = filepath.Abs(folder)
+	if err != nil {
+		return
+	}
+	fi, err := os.Stat(folder)
+	if err != nil {
+		return
+	}
+	if !fi.IsDir() {
+		err = fmt.Errorf("'%s' is not a folder", folder)
+		return
+	}
+	m.Folder = filepath.ToSlash(folder)
+	return
+}
+
+// mount is a folder being watched, with the rules of what is
+// ignored in it
+type mount struct {
+	Mount
+	ignore  *ignorer
+	watcher *fsnotify.Watcher
+}
+
+// mounts returns the folders to serve, longest prefix first, with
+// Folder at the root unless something else is mounted there
+func (c *client) mounts() (ms []*mount) {
+	root := c.Folder != ""
+	for _, m := range c.Mounts {
+		if m.Prefix == "" {
+			root = false
+		}
+	}
+	all := append([]Mount{}, c.Mounts...)
+	if root {
+		all = append(all, Mount{Folder: c.Folder})
+	}
+	for _, m := range all {
+		ms = append(ms, &mount{
+			Mount:  m,
+			ignore: newIgnorer(m.Folder, c.Exclude, c.Include),
+		})
+	}
+	sort.SliceStable(ms, func(i, j int) bool {
+		return len(ms[i].Prefix) > len(ms[j].Prefix)
+	})
+	return
+}
+
+// mountFor returns the mount a path of the site is served from, and
+// the path inside it, where the longest prefix wins
+func (c *client) mountFor(name string) (m *mount, rel string) {
+	for _, m := range c.mounted {
+		if m.Prefix == "" {
+			return m, name
+		} else if name == m.Prefix {
+			return m, ""
+		} else if strings.HasPrefix(name, m.Prefix+"/") {
+			return m, strings.TrimPrefix(name, m.Prefix+"/")
+		}
+	}
+	return nil, ""
+}
+
+// ignored returns whether a path of the site is kept out of it, as
+// are files still being uploaded
+func (c *client) ignored(name string, isDir bool) bool {
+	m, rel := c.mountFor(name)
+	if m == nil || isPartial(name) {
+		return true
+	}
+	return rel != "" && m.ignore.ignored(rel, isDir)
+}
+
+// path returns the path of the site for a path inside the mount
+func (m *mount) path(rel string) string {
+	if m.Prefix == "" {
+		return rel
+	} else if rel == "" {
+		return m.Prefix
+	}
+	return m.Prefix + "/" + rel
+}
+
+// file returns where a path inside the mount is on disk
+func (m *mount) file(rel string) string {
+	return filepath.Join(filepath.FromSlash(m.Folder), filepath.FromSlash(rel))
+}
+
+// relative returns the path of a file in the folder of the mount
+// relative to it with forward slashes
+func (m *mount) relative(name string) (rel string, ok bool) {
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return
+	}
+	rel, err = filepath.Rel(filepath.FromSlash(m.Folder), name)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
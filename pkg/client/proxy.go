@@ -0,0 +1,101 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/schollz/hostyoself/pkg/utils"
+	"github.com/schollz/hostyoself/pkg/wsconn"
+	log "github.com/schollz/logger"
+)
+
+// proxyClient passes redirects back to the visitor instead of following them
+var proxyClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// sendProxy forwards a request from the relay to the local server
+// and streams its response back
+func (c *client) sendProxy(ws *wsconn.WebsocketConn, p wsconn.Payload, cancel <-chan struct{}) (err error) {
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+	go func() {
+		select {
+		case <-cancel:
+			cancelCtx()
+		case <-ctx.Done():
+		}
+	}()
+
+	// the path comes escaped as the visitor sent it, so that escaped
+	// slashes, question marks and hashes stay part of it
+	target, err := url.Parse(c.Proxy)
+	if err != nil {
+		return
+	}
+	escaped := strings.TrimSuffix(target.EscapedPath(), "/") + "/" + strings.TrimPrefix(p.Message, "/")
+	target.Path, err = url.PathUnescape(escaped)
+	if err != nil {
+		return
+	}
+	target.RawPath = escaped
+	target.RawQuery = p.Query
+	method := p.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequest(method, target.String(), bytes.NewReader(p.Body))
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	if p.Header != nil {
+		req.Header = utils.RemoveHopHeaders(p.Header)
+	}
+	if p.IPAddress != "" {
+		req.Header.Set("X-Forwarded-For", p.IPAddress)
+	}
+
+	resp, err := proxyClient.Do(req)
+	if err != nil {
+		log.Debug(err)
+		log.Infof("%s%s %s %s 502", c.Label, p.IPAddress, method, p.Message)
+		return ws.Send(wsconn.Payload{
+			ID:      p.ID,
+			Type:    "get",
+			Success: false,
+			Message: fmt.Sprintf("could not reach %s", c.Proxy),
+			Key:     c.Key,
+		})
+	}
+	defer resp.Body.Close()
+
+	header := utils.RemoveHopHeaders(resp.Header)
+	// redirects to the local server become redirects within the domain
+	if location := header.Get("Location"); strings.HasPrefix(location, strings.TrimSuffix(c.Proxy, "/")) {
+		header.Set("Location", "/"+strings.TrimPrefix(strings.TrimPrefix(location, strings.TrimSuffix(c.Proxy, "/")), "/"))
+	}
+	size := resp.ContentLength
+	if size < 0 || method == http.MethodHead {
+		size = 0
+	}
+
+	log.Infof("%s%s %s %s %d", c.Label, p.IPAddress, method, p.Message, resp.StatusCode)
+	return c.respond(ws, p, wsconn.Payload{
+		ID:          p.ID,
+		Type:        "get",
+		Success:     true,
+		Status:      resp.StatusCode,
+		Header:      header,
+		Size:        size,
+		ContentType: resp.Header.Get("Content-Type"),
+		Key:         c.Key,
+	}, resp.Body, cancel)
+}
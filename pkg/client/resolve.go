@@ -0,0 +1,73 @@
+package client
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// errBadPath is returned for requests that don't name a file in a
+// folder being served
+var errBadPath = errors.New("bad path")
+
+// errSymlink is returned for requests through a symlink when symlinks
+// aren't followed, and through folders that are symlinks when they are
+var errSymlink = errors.New("symlinks are not followed")
+
+// resolve returns the file on disk for a path requested by the relay.
+// The path is cleaned, can't leave the folder of its mount and can't
+// go through a symlink unless FollowSymlinks is set, in which case
+// symlinks to files are trusted wherever they point. Folders that are
+// symlinks are never gone through.
+func (c *client) resolve(name string) (file string, err error) {
+	if strings.ContainsAny(name, "\x00\\") {
+		return "", errBadPath
+	}
+	rel := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if rel == "" || rel != strings.TrimSuffix(strings.TrimPrefix(name, "/"), "/") {
+		// anything with .. or // is not how paths are listed
+		return "", errBadPath
+	}
+
+	m, rel := c.mountFor(rel)
+	if m == nil || rel == "" {
+		return "", errBadPath
+	}
+	root := filepath.FromSlash(m.Folder)
+	file = root
+	segments := strings.Split(rel, "/")
+	for i, segment := range segments {
+		if filepath.VolumeName(segment) != "" || strings.ContainsRune(segment, filepath.Separator) {
+			return "", errBadPath
+		}
+		file = filepath.Join(file, segment)
+		var fi os.FileInfo
+		fi, err = os.Lstat(file)
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 && (!c.FollowSymlinks || i < len(segments)-1) {
+			return "", errSymlink
+		}
+	}
+
+	if c.FollowSymlinks {
+		file, err = filepath.EvalSymlinks(file)
+		if err != nil {
+			return "", err
+		}
+	} else if r, errRel := filepath.Rel(root, file); errRel != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", errBadPath
+	}
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", errBadPath
+	}
+	return
+}
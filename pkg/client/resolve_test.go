@@ -0,0 +1,89 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// within returns whether file is root or in it
+func within(root, file string) bool {
+	rel, err := filepath.Rel(root, file)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// FuzzResolve checks that a requested path is refused or resolves to a
+// file in a folder being served. With FollowSymlinks, the only way out
+// is a symlink to a file named by the request.
+func FuzzResolve(f *testing.F) {
+	dir := f.TempDir()
+	root := filepath.Join(dir, "root")
+	for _, name := range []string{"root/a.txt", "root/sub/b.txt", "other/c.txt", "outside/secret.txt"} {
+		write(f, filepath.Join(dir, filepath.FromSlash(name)), name)
+	}
+	links := map[string]string{
+		"link-in":  "a.txt",
+		"link-out": filepath.Join("..", "outside", "secret.txt"),
+		"dir-in":   "sub",
+		"dir-out":  filepath.Join("..", "outside"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			f.Skip("symlinks are not supported:", err)
+		}
+	}
+
+	clients := make(map[bool]*client)
+	for _, follow := range []bool{false, true} {
+		c := testClient(f, root, "")
+		m, err := NewMount("/m", filepath.Join(dir, "other"))
+		if err != nil {
+			f.Fatal(err)
+		}
+		c.Mounts = []Mount{m}
+		c.mounted = c.mounts()
+		c.FollowSymlinks = follow
+		clients[follow] = c
+	}
+	var roots []string
+	for _, m := range clients[false].mounted {
+		r, err := filepath.EvalSymlinks(filepath.FromSlash(m.Folder))
+		if err != nil {
+			f.Fatal(err)
+		}
+		roots = append(roots, r)
+	}
+
+	f.Fuzz(func(t *testing.T, name string, follow bool) {
+		c := clients[follow]
+		file, err := c.resolve(name)
+		if err != nil {
+			return
+		}
+		real, err := filepath.EvalSymlinks(file)
+		if err != nil {
+			t.Fatalf("%q resolved to %s which is not there: %s", name, file, err.Error())
+		}
+		for _, r := range roots {
+			if within(r, real) {
+				return
+			}
+		}
+		if !follow {
+			t.Fatalf("%q resolved to %s outside the folders", name, real)
+		}
+		m, rel := c.mountFor(strings.Trim(name, "/"))
+		if m == nil {
+			t.Fatalf("%q resolved to %s without a mount", name, real)
+		}
+		fi, err := os.Lstat(m.file(rel))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			t.Fatalf("%q resolved to %s outside the folders without a symlink", name, real)
+		}
+		parent, err := filepath.EvalSymlinks(filepath.Dir(m.file(rel)))
+		if err != nil || !within(filepath.FromSlash(m.Folder), parent) {
+			t.Fatalf("%q resolved to %s through a folder outside the folders", name, real)
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/schollz/hostyoself/pkg/wsconn"
+	log "github.com/schollz/logger"
+	"github.com/vincent-petithory/dataurl"
+)
+
+// upload receives the chunks of a file uploaded by a visitor
+type upload struct {
+	ch   chan wsconn.Payload
+	done chan struct{}
+}
+
+// uploadBuffer is the number of chunks held for an upload before
+// the connection waits on it
+const uploadBuffer = 16
+
+// maxNameLength is the longest name given to an uploaded file
+const maxNameLength = 200
+
+// partialPrefix starts the names files are uploaded under until all
+// of them is there, which are never part of the site
+const partialPrefix = ".hostyoself-upload-"
+
+// isPartial returns whether a path is of a file still being uploaded
+func isPartial(name string) bool {
+	return strings.HasPrefix(path.Base(name), partialPrefix)
+}
+
+// receiveUpload writes a file uploaded by a visitor into the upload
+// folder, under a new name if the name is taken. It is only given the
+// name once all of it is written, so that it isn't served before.
+func (c *client) receiveUpload(ws *wsconn.WebsocketConn, p wsconn.Payload, u *upload, cancel <-chan struct{}) (err error) {
+	defer func() {
+		c.Lock()
+		if c.uploads[p.ID] == u {
+			delete(c.uploads, p.ID)
+		}
+		c.Unlock()
+		close(u.done)
+	}()
+	reply := func(success bool, status int, message string) error {
+		return ws.Send(wsconn.Payload{
+			ID:      p.ID,
+			Type:    "upload",
+			Success: success,
+			Status:  status,
+			Message: message,
+			Key:     c.Key,
+		})
+	}
+
+	if c.Upload == "" {
+		log.Infof("%s%s upload refused", c.Label, p.IPAddress)
+		return reply(false, http.StatusForbidden, "uploads are not allowed")
+	}
+	saved := strings.TrimPrefix(path.Clean("/"+c.Upload), "/")
+	m, rel := c.mountFor(saved)
+	if m == nil {
+		log.Infof("%s%s upload refused, /%s is not in a folder being served", c.Label, p.IPAddress, saved)
+		return reply(false, http.StatusForbidden, "uploads are not allowed")
+	}
+	folder := m.file(rel)
+	err = os.MkdirAll(folder, 0755)
+	if err != nil {
+		reply(false, http.StatusInternalServerError, "could not save file")
+		return
+	}
+	name := uploadName(p.Message)
+	f, err := ioutil.TempFile(folder, partialPrefix)
+	if err != nil {
+		reply(false, http.StatusInternalServerError, "could not save file")
+		return
+	}
+
+	var written int64
+	for next := 0; ; next++ {
+		var chunk wsconn.Payload
+		var ok bool
+		select {
+		case chunk, ok = <-u.ch:
+		case <-cancel:
+			ok = false
+		}
+		if !ok || !chunk.Success || chunk.Chunk != next {
+			f.Close()
+			os.Remove(f.Name())
+			return fmt.Errorf("upload of %s stopped", name)
+		}
+
+		data := chunk.Data
+		if data == nil && chunk.Message != "" {
+			var dataURL *dataurl.DataURL
+			dataURL, err = dataurl.DecodeString(chunk.Message)
+			if err != nil {
+				f.Close()
+				os.Remove(f.Name())
+				reply(false, http.StatusBadRequest, "bad chunk")
+				return
+			}
+			data = dataURL.Data
+		}
+		written += int64(len(data))
+		if c.UploadLimit > 0 && written > c.UploadLimit {
+			f.Close()
+			os.Remove(f.Name())
+			log.Infof("%s%s upload of %s is too large", c.Label, p.IPAddress, name)
+			return reply(false, http.StatusRequestEntityTooLarge, fmt.Sprintf("files can be at most %d bytes", c.UploadLimit))
+		}
+		_, err = f.Write(data)
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			reply(false, http.StatusInternalServerError, "could not save file")
+			return
+		}
+		if chunk.Done {
+			break
+		}
+	}
+	err = f.Close()
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		name, err = renameUnique(f.Name(), folder, name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		reply(false, http.StatusInternalServerError, "could not save file")
+		return
+	}
+
+	// the file can be served right away
+	saved = strings.TrimPrefix(path.Join(saved, name), "/")
+	if fi, errStat := os.Stat(filepath.Join(folder, name)); errStat == nil && c.index(saved, fi) {
+		c.invalidate(saved)
+	}
+	log.Infof("%s%s uploaded /%s (%d bytes)", c.Label, p.IPAddress, saved, written)
+	return reply(true, http.StatusCreated, saved)
+}
+
+// uploadName makes the name a visitor gave a file safe to write,
+// keeping only its base name and plain characters
+func uploadName(name string) string {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._- ", r) {
+			return r
+		}
+		return '_'
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if runes := []rune(name); len(runes) > maxNameLength {
+		ext := []rune(filepath.Ext(name))
+		if len(ext) > 16 {
+			ext = nil
+		}
+		name = strings.TrimSpace(string(runes[:maxNameLength-len(ext)])) + string(ext)
+	}
+	if name == "" {
+		name = "upload"
+	}
+	return name
+}
+
+// renameUnique gives a finished upload its name in folder, adding a
+// number to the name if there is a file with it already
+func renameUnique(partial, folder, name string) (created string, err error) {
+	ext := filepath.Ext(name)
+	for i := 0; i < 1000; i++ {
+		created = name
+		if i > 0 {
+			created = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), i, ext)
+		}
+		target := filepath.Join(folder, created)
+		// a link fails rather than replace a file that has the name
+		err = os.Link(partial, target)
+		if err == nil {
+			os.Remove(partial)
+			return
+		} else if os.IsExist(err) {
+			continue
+		}
+		// which filesystems without links make do without
+		if _, errStat := os.Lstat(target); os.IsNotExist(errStat) {
+			err = os.Rename(partial, target)
+			return
+		}
+	}
+	err = fmt.Errorf("too many files named %s", name)
+	return
+}
+
+// uploaded returns whether a path of the site is in the upload folder
+func (c *client) uploaded(name string) bool {
+	if c.Upload == "" {
+		return false
+	}
+	folder := strings.TrimPrefix(path.Clean("/"+c.Upload), "/")
+	return folder == "" || strings.HasPrefix(name, folder+"/")
+}
@@ -0,0 +1,227 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/schollz/hostyoself/pkg/wsconn"
+	"github.com/vincent-petithory/dataurl"
+)
+
+func TestUploadName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "notes.txt", want: "notes.txt"},
+		{name: "my notes.txt", want: "my notes.txt"},
+		{name: "../../etc/passwd", want: "passwd"},
+		{name: `C:\Users\me\notes.txt`, want: "notes.txt"},
+		{name: ".htaccess", want: "htaccess"},
+		{name: ".hostyoself-upload-x", want: "hostyoself-upload-x"},
+		{name: "a<b>|c?.txt", want: "a_b__c_.txt"},
+		{name: "résumé.pdf", want: "résumé.pdf"},
+		{name: "", want: "upload"},
+		{name: "..", want: "upload"},
+		{name: "/", want: "_"},
+		{name: strings.Repeat("a", 300) + ".txt", want: strings.Repeat("a", maxNameLength-4) + ".txt"},
+		{name: strings.Repeat("a", 300) + "." + strings.Repeat("b", 20), want: strings.Repeat("a", maxNameLength)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := uploadName(tt.name); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenameUnique(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		want     string
+	}{
+		{name: "notes.txt", want: "notes.txt"},
+		{name: "notes.txt", existing: []string{"notes.txt"}, want: "notes-1.txt"},
+		{name: "notes.txt", existing: []string{"notes.txt", "notes-1.txt"}, want: "notes-2.txt"},
+		{name: "notes.txt", existing: []string{"notes-1.txt"}, want: "notes.txt"},
+		{name: "README", existing: []string{"README"}, want: "README-1"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(append(tt.existing, tt.name), ","), func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.existing {
+				write(t, filepath.Join(dir, name), "old")
+			}
+			partial := filepath.Join(dir, partialPrefix+"1")
+			write(t, partial, "new")
+
+			got, err := renameUnique(partial, dir, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if b, _ := ioutil.ReadFile(filepath.Join(dir, got)); string(b) != "new" {
+				t.Errorf("%s holds %q, want %q", got, b, "new")
+			}
+			for _, name := range tt.existing {
+				if b, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(b) != "old" {
+					t.Errorf("%s was replaced", name)
+				}
+			}
+			if _, err := os.Stat(partial); !os.IsNotExist(err) {
+				t.Error("the partial file is still there")
+			}
+		})
+	}
+}
+
+func TestReceiveUpload(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		limit    int64
+		chunks   []string
+		// gone is set if the relay goes away instead of
+		// sending the last chunk
+		gone       bool
+		wantStatus int
+		// want is what the upload folder holds afterwards
+		want map[string]string
+	}{
+		{
+			name:       "saved",
+			chunks:     []string{"hello ", "world"},
+			wantStatus: http.StatusCreated,
+			want:       map[string]string{"notes.txt": "hello world"},
+		},
+		{
+			name:       "name taken",
+			existing:   []string{"notes.txt"},
+			chunks:     []string{"hello"},
+			wantStatus: http.StatusCreated,
+			want:       map[string]string{"notes.txt": "notes.txt", "notes-1.txt": "hello"},
+		},
+		{
+			name:       "at the limit",
+			limit:      5,
+			chunks:     []string{"hel", "lo"},
+			wantStatus: http.StatusCreated,
+			want:       map[string]string{"notes.txt": "hello"},
+		},
+		{
+			name:       "too large",
+			limit:      5,
+			chunks:     []string{"hel", "lo!"},
+			wantStatus: http.StatusRequestEntityTooLarge,
+			want:       map[string]string{},
+		},
+		{
+			name:   "relay gone",
+			chunks: []string{"hello"},
+			gone:   true,
+			want:   map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			uploads := filepath.Join(dir, "uploads")
+			for _, name := range tt.existing {
+				write(t, filepath.Join(uploads, name), name)
+			}
+			c := testClient(t, dir, "")
+			c.Upload = "uploads"
+			c.UploadLimit = tt.limit
+
+			replies := make(chan wsconn.Payload, 1)
+			testRelay(t, c, false, false, func(ws *wsconn.WebsocketConn) {
+				ws.Send(wsconn.Payload{ID: 1, Type: "upload", Message: "notes.txt"})
+				for i, chunk := range tt.chunks {
+					last := i == len(tt.chunks)-1
+					if last && tt.gone {
+						// the file is left half written
+						time.Sleep(50 * time.Millisecond)
+						return
+					}
+					ws.Send(wsconn.Payload{
+						ID:      1,
+						Type:    "chunk",
+						Success: true,
+						Chunk:   i,
+						Done:    last,
+						Message: dataurl.EncodeBytes([]byte(chunk)),
+					})
+				}
+				for {
+					p, err := ws.Receive()
+					if err != nil {
+						return
+					}
+					if p.Type == "upload" {
+						replies <- p
+						return
+					}
+				}
+			})
+
+			done := make(chan error, 1)
+			go func() { done <- c.Run() }()
+			if tt.gone {
+				<-done
+				// the upload gives up once Run returns and
+				// takes its partial file with it
+				for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+					if fis, _ := ioutil.ReadDir(uploads); len(fis) == 0 {
+						break
+					}
+				}
+			} else {
+				select {
+				case p := <-replies:
+					if p.Status != tt.wantStatus {
+						t.Fatalf("got status %d (%s), want %d", p.Status, p.Message, tt.wantStatus)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("the upload was never answered")
+				}
+			}
+
+			got := make(map[string]string)
+			fis, _ := ioutil.ReadDir(uploads)
+			for _, fi := range fis {
+				b, _ := ioutil.ReadFile(filepath.Join(uploads, fi.Name()))
+				got[fi.Name()] = string(b)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for name, data := range tt.want {
+				if got[name] != data {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPartialUploadsIgnored(t *testing.T) {
+	c := testClient(t, t.TempDir(), "")
+	for name, want := range map[string]bool{
+		"uploads/" + partialPrefix + "123": true,
+		partialPrefix + "123":              true,
+		"uploads/notes.txt":                false,
+	} {
+		if got := c.ignored(name, false); got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+}
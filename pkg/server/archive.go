@@ -0,0 +1,176 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/schollz/hostyoself/pkg/wsconn"
+	log "github.com/schollz/logger"
+)
+
+// archiveWriter adds files to an archive as they are fetched
+type archiveWriter interface {
+	add(name string, size int64, modified time.Time, body io.Reader) error
+	Close() error
+}
+
+// archive streams every file of a folder of a domain to the visitor
+// as a zip or tar.gz, fetching them from the hosts one at a time
+func (s *server) archive(w http.ResponseWriter, r *http.Request, domain, urlPath, format, ipAddress string) (err error) {
+	if format != "zip" && format != "tar.gz" {
+		http.Error(w, "archives can be zip or tar.gz", http.StatusBadRequest)
+		return nil
+	}
+
+	fs, err := s.getFiles(r.Context(), domain, ipAddress)
+	if err == errHostTimeout {
+		http.Error(w, "gateway timeout", http.StatusGatewayTimeout)
+		return nil
+	} else if err != nil {
+		log.Debug(err)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return nil
+	}
+	folder := strings.TrimPrefix(urlPath, "/")
+	var files []string
+	for _, f := range fs {
+		if f.name() != "" && !f.IsDir && strings.HasPrefix(f.name(), folder) {
+			files = append(files, f.name())
+		}
+	}
+	if len(files) == 0 {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil
+	}
+	sort.Strings(files)
+
+	name := domain
+	if folder != "" {
+		name += "-" + strings.Replace(strings.Trim(folder, "/"), "/", "-", -1)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, name, format))
+	var aw archiveWriter
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		aw = &zipArchive{zip.NewWriter(w)}
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		gz := gzip.NewWriter(w)
+		aw = &tarArchive{tar.NewWriter(gz), gz}
+	}
+	log.Debugf("archiving %d files of %s/%s", len(files), domain, folder)
+
+	for _, file := range files {
+		req := wsconn.Payload{
+			Method:    http.MethodGet,
+			IPAddress: ipAddress,
+		}
+		resp, body, errGet := s.get(r.Context(), domain, file, req)
+		if notFound(errGet) {
+			// the file went away since the listing
+			continue
+		} else if errGet != nil {
+			log.Debugf("problem archiving %s/%s: %s", domain, file, errGet.Error())
+			return nil
+		}
+		if resp.Status != http.StatusOK {
+			body.Close()
+			continue
+		}
+		errAdd := aw.add(name+"/"+strings.TrimPrefix(file, folder), resp.Size, modified(resp), body)
+		body.Close()
+		if errAdd != nil {
+			// the visitor gets a cut off archive, as
+			// the headers were sent already
+			log.Debugf("problem archiving %s/%s: %s", domain, file, errAdd.Error())
+			return nil
+		}
+	}
+	err = aw.Close()
+	if err != nil {
+		log.Debug(err)
+		err = nil
+	}
+	return
+}
+
+// zipArchive writes files to a zip
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (a *zipArchive) add(name string, size int64, modified time.Time, body io.Reader) (err error) {
+	fh := &zip.FileHeader{
+		Name:   name,
+		Method: zip.Deflate,
+	}
+	if !modified.IsZero() {
+		fh.Modified = modified
+	}
+	f, err := a.CreateHeader(fh)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(f, body)
+	return
+}
+
+// tarArchive writes files to a gzipped tar
+type tarArchive struct {
+	*tar.Writer
+	gz *gzip.Writer
+}
+
+func (a *tarArchive) add(name string, size int64, modified time.Time, body io.Reader) (err error) {
+	if size <= 0 {
+		// tar needs to know the size up front, which
+		// hosts usually say but don't have to
+		var b []byte
+		b, err = ioutil.ReadAll(body)
+		if err != nil {
+			return
+		}
+		size = int64(len(b))
+		body = bytes.NewReader(b)
+	}
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+	err = a.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: modified,
+	})
+	if err != nil {
+		return
+	}
+	_, err = io.CopyN(a.Writer, body, size)
+	return
+}
+
+func (a *tarArchive) Close() (err error) {
+	err = a.Writer.Close()
+	if err != nil {
+		return
+	}
+	return a.gz.Close()
+}
+
+// archiveFormat returns the archive asked for in the query of a
+// request for a folder, if any
+func archiveFormat(r *http.Request, urlPath string) string {
+	if r.Method != http.MethodGet || (urlPath != "" && !strings.HasSuffix(urlPath, "/")) {
+		return ""
+	}
+	return r.URL.Query().Get("archive")
+}
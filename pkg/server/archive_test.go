@@ -0,0 +1,136 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// unarchive returns the contents of a zip or tar.gz by file name
+func unarchive(t *testing.T, format string, b []byte) map[string]string {
+	files := make(map[string]string)
+	if format == "zip" {
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[f.Name] = string(data)
+		}
+		return files
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[h.Name] = string(data)
+	}
+	return files
+}
+
+func TestArchive(t *testing.T) {
+	s := New("http://relay.test", "8001")
+	conn := echoHost(t, "site", "key")
+	conn.Links = []string{"files/secret.zip"}
+	s.conn["site"] = []*connection{conn}
+
+	tests := []struct {
+		name   string
+		path   string
+		format string
+		status int
+		// filename is the name the archive is saved as, and files
+		// what is in it by name
+		filename string
+		files    map[string]string
+	}{
+		{
+			name:     "zip",
+			path:     "/site/files/?archive=zip",
+			format:   "zip",
+			status:   http.StatusOK,
+			filename: "site-files.zip",
+			files: map[string]string{
+				"site-files/A.txt":         "files/A.txt",
+				"site-files/b.txt":         "files/b.txt",
+				"site-files/c.txt":         "files/c.txt",
+				"site-files/docs/guide.md": "files/docs/guide.md",
+				"site-files/docs/notes.md": "files/docs/notes.md",
+			},
+		},
+		{
+			name:     "tar.gz",
+			path:     "/site/files/?archive=tar.gz",
+			format:   "tar.gz",
+			status:   http.StatusOK,
+			filename: "site-files.tar.gz",
+			files: map[string]string{
+				"site-files/A.txt":         "files/A.txt",
+				"site-files/b.txt":         "files/b.txt",
+				"site-files/c.txt":         "files/c.txt",
+				"site-files/docs/guide.md": "files/docs/guide.md",
+				"site-files/docs/notes.md": "files/docs/notes.md",
+			},
+		},
+		{
+			name:     "subfolder",
+			path:     "/site/files/docs/?archive=zip",
+			format:   "zip",
+			status:   http.StatusOK,
+			filename: "site-files-docs.zip",
+			files: map[string]string{
+				"site-files-docs/guide.md": "files/docs/guide.md",
+				"site-files-docs/notes.md": "files/docs/notes.md",
+			},
+		},
+		{name: "other format", path: "/site/files/?archive=rar", status: http.StatusBadRequest},
+		{name: "empty folder", path: "/site/nothing/?archive=zip", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.handler(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.status {
+				t.Fatalf("got %d, want %d", w.Code, tt.status)
+			}
+			if tt.files == nil {
+				return
+			}
+			want := `attachment; filename="` + tt.filename + `"`
+			if got := w.Header().Get("Content-Disposition"); got != want {
+				t.Errorf("got Content-Disposition %q, want %q", got, want)
+			}
+			if got := unarchive(t, tt.format, w.Body.Bytes()); !reflect.DeepEqual(got, tt.files) {
+				t.Errorf("got %v, want %v", got, tt.files)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"github.com/schollz/hostyoself/pkg/utils"
+)
+
+// authCookie is the name of the cookie that remembers a token
+const authCookie = "hostyoself"
+
+// authorize checks that a visitor may see a protected domain, with
+// Basic auth, a token in the query or a cookie set by an earlier token.
+// Visitors that may not are asked for a password.
+func (s *server) authorize(w http.ResponseWriter, r *http.Request, domain, prefix string) bool {
+	// challenge files are fetched by the relay itself
+	if s.challenged(r, domain, prefix) {
+		return true
+	}
+	// domains are public unless their hosts sent credentials
+	connections := s.connections(domain)
+	if len(connections) == 0 || len(connections[0].Credentials) == 0 {
+		return true
+	}
+	credentials := connections[0].Credentials
+
+	if token := r.URL.Query().Get("token"); token != "" && signedToken(connections, domain, token) {
+		path := prefix
+		if path == "" {
+			path = "/"
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     authCookie,
+			Value:    token,
+			Path:     path,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		// the token is for the relay, not the host
+		q := r.URL.Query()
+		q.Del("token")
+		r.URL.RawQuery = q.Encode()
+		return true
+	}
+	if c, err := r.Cookie(authCookie); err == nil && signedToken(connections, domain, c.Value) {
+		dropCookie(r, authCookie)
+		return true
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		hash := utils.PasswordHash(password)
+		h, ok := credentials[user]
+		if !ok {
+			// entries without a user take any user
+			h, ok = credentials[""]
+		}
+		if ok && equal(hash, h) {
+			r.Header.Del("Authorization")
+			return true
+		}
+	}
+
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, domain))
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// signedToken returns whether a token was signed by any host of a
+// domain. Hosts that don't sign tokens don't let anyone in with one.
+func signedToken(connections []*connection, domain, token string) bool {
+	for _, c := range connections {
+		if c.Secret != "" && equal(token, utils.SiteToken(domain, c.Secret)) {
+			return true
+		}
+	}
+	return false
+}
+
+// equal compares secrets in constant time
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// dropCookie removes a cookie meant for the relay from a request
+// before it is passed on to a host
+func dropCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			r.AddCookie(c)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/schollz/hostyoself/pkg/utils"
+)
+
+func TestAuthorize(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef"
+	// the site has a second host with a secret of its own
+	const other = "fedcba9876543210fedcba9876543210"
+	tests := []struct {
+		name   string
+		secret string
+		// token and cookie are sent if set, and so is user:password
+		token    string
+		cookie   string
+		user     string
+		password string
+		want     bool
+	}{
+		{name: "nothing", secret: secret},
+		{name: "token", secret: secret, token: utils.SiteToken("site", secret), want: true},
+		{name: "cookie", secret: secret, cookie: utils.SiteToken("site", secret), want: true},
+		{name: "token of the second host", secret: secret, token: utils.SiteToken("site", other), want: true},
+		{name: "cookie of the second host", secret: secret, cookie: utils.SiteToken("site", other), want: true},
+		{name: "token signed with the key", secret: secret, token: utils.SiteToken("site", "key")},
+		{name: "token for another site", secret: secret, token: utils.SiteToken("other", secret)},
+		{name: "token without a secret", token: utils.SiteToken("site", "")},
+		{name: "token of the second host without a secret", token: utils.SiteToken("site", other), want: true},
+		{name: "cookie without a secret", cookie: utils.SiteToken("site", "")},
+		{name: "password", secret: secret, user: "anyone", password: "hunter2", want: true},
+		{name: "wrong password", secret: secret, user: "anyone", password: "hunter3"},
+		{name: "user", user: "alice", password: "correcthorse", want: true},
+		{name: "user with the password for anyone", user: "alice", password: "hunter2"},
+		{name: "user with a wrong password", user: "alice", password: "batterystaple"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("http://relay.test", "8001")
+			conn := testConnection(t, "site", "key")
+			conn.Secret = tt.secret
+			conn.Credentials = map[string]string{
+				"":      utils.PasswordHash("hunter2"),
+				"alice": utils.PasswordHash("correcthorse"),
+			}
+			second := testConnection(t, "site", "key")
+			second.Secret = other
+			s.conn["site"] = []*connection{conn, second}
+
+			target := "/site/"
+			if tt.token != "" {
+				target += "?token=" + tt.token
+			}
+			r := httptest.NewRequest("GET", target, nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: authCookie, Value: tt.cookie})
+			}
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.password)
+			}
+			w := httptest.NewRecorder()
+			if got := s.authorize(w, r, "site", "/site"); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/hostyoself/pkg/wsconn"
+)
+
+// cache keeps complete responses from hosts in memory, dropping the
+// least recently used ones when it grows past its size
+type cache struct {
+	maxSize int64
+	ttl     time.Duration
+
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+
+	// generation counts the changes to files of the hosts, and changed
+	// holds the generation each file last changed at, by key, while
+	// responses are being fetched to be added. A response isn't added
+	// if its file changed after it was fetched.
+	generation uint64
+	changed    map[string]uint64
+	fetching   int
+	sync.Mutex
+}
+
+// cacheEntry is a response stored under domain/path
+type cacheEntry struct {
+	key     string
+	domain  string
+	path    string
+	payload wsconn.Payload
+	data    []byte
+	expires time.Time
+}
+
+func newCache(maxSize int64, ttl time.Duration) *cache {
+	return &cache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+		changed: make(map[string]uint64),
+	}
+}
+
+func cacheKey(domain, path string) string {
+	return domain + "/" + path
+}
+
+// maxEntry returns the size of the largest response worth keeping
+func (c *cache) maxEntry() int64 {
+	return c.maxSize / 8
+}
+
+// get returns the response stored for a requested path, if it hasn't expired
+func (c *cache) get(domain, requested string) (e *cacheEntry, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.items[cacheKey(domain, requested)]
+	if !ok {
+		return
+	}
+	e = el.Value.(*cacheEntry)
+	if c.ttl > 0 && time.Now().After(e.expires) {
+		c.removeElement(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return
+}
+
+// begin returns the generation a response starts being fetched at,
+// which is given to add. done is called once it is added or given up.
+func (c *cache) begin() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	c.fetching++
+	return c.generation
+}
+
+// done forgets the changes that happened during fetches once none
+// are left
+func (c *cache) done() {
+	c.Lock()
+	defer c.Unlock()
+	c.fetching--
+	if c.fetching == 0 && len(c.changed) > 0 {
+		c.changed = make(map[string]uint64)
+	}
+}
+
+// change records that the responses under a key changed
+func (c *cache) change(key string) {
+	c.generation++
+	if c.fetching > 0 {
+		c.changed[key] = c.generation
+	}
+}
+
+// add stores the response to a requested path, which was served from
+// the file at path, unless it changed since the generation it was
+// fetched at
+func (c *cache) add(domain, requested, path string, p wsconn.Payload, data []byte, generation uint64) {
+	if int64(len(data)) > c.maxEntry() {
+		return
+	}
+	p.Message = ""
+	p.Body = nil
+	p.Data = nil
+
+	c.Lock()
+	defer c.Unlock()
+	for _, key := range []string{cacheKey(domain, ""), cacheKey(domain, path), cacheKey(domain, requested)} {
+		if c.changed[key] > generation {
+			return
+		}
+	}
+	key := cacheKey(domain, requested)
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+	c.items[key] = c.ll.PushFront(&cacheEntry{
+		key:     key,
+		domain:  domain,
+		path:    path,
+		payload: p,
+		data:    data,
+		expires: time.Now().Add(c.ttl),
+	})
+	c.size += int64(len(data))
+	for c.size > c.maxSize {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// invalidate drops the responses served from a file of a domain
+func (c *cache) invalidate(domain, path string) {
+	path = strings.TrimPrefix(path, "/")
+	c.Lock()
+	defer c.Unlock()
+	c.change(cacheKey(domain, path))
+	for _, el := range c.items {
+		e := el.Value.(*cacheEntry)
+		if e.domain == domain && (e.path == path || e.key == cacheKey(domain, path)) {
+			c.removeElement(el)
+		}
+	}
+}
+
+// clear drops all the responses of a domain
+func (c *cache) clear(domain string) {
+	c.Lock()
+	defer c.Unlock()
+	c.change(cacheKey(domain, ""))
+	for _, el := range c.items {
+		if el.Value.(*cacheEntry).domain == domain {
+			c.removeElement(el)
+		}
+	}
+}
+
+func (c *cache) removeElement(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.ll.Remove(el)
+	delete(c.items, e.key)
+	c.size -= int64(len(e.data))
+}
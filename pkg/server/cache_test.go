@@ -0,0 +1,277 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/schollz/hostyoself/pkg/wsconn"
+	"github.com/vincent-petithory/dataurl"
+)
+
+// bytesOf returns data of a size to cache
+func bytesOf(size int) []byte {
+	return []byte(strings.Repeat("x", size))
+}
+
+func TestCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize int64
+		ttl     time.Duration
+		run     func(c *cache)
+		// want is what is left in the cache, most recently used first
+		want []string
+	}{
+		{
+			name:    "most recent first",
+			maxSize: 80,
+			run: func(c *cache) {
+				c.add("a", "1.html", "1.html", wsconn.Payload{}, bytesOf(10), 0)
+				c.add("a", "2.html", "2.html", wsconn.Payload{}, bytesOf(10), 0)
+			},
+			want: []string{"a/2.html", "a/1.html"},
+		},
+		{
+			name:    "least recently used dropped",
+			maxSize: 80,
+			run: func(c *cache) {
+				for _, name := range []string{"1", "2", "3", "4", "5", "6", "7", "8", "9"} {
+					c.add("a", name, name, wsconn.Payload{}, bytesOf(10), 0)
+				}
+			},
+			want: []string{"a/9", "a/8", "a/7", "a/6", "a/5", "a/4", "a/3", "a/2"},
+		},
+		{
+			name:    "used entries kept",
+			maxSize: 80,
+			run: func(c *cache) {
+				for _, name := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+					c.add("a", name, name, wsconn.Payload{}, bytesOf(10), 0)
+				}
+				c.get("a", "1")
+				c.add("a", "9", "9", wsconn.Payload{}, bytesOf(10), 0)
+			},
+			want: []string{"a/9", "a/1", "a/8", "a/7", "a/6", "a/5", "a/4", "a/3"},
+		},
+		{
+			name:    "too large to keep",
+			maxSize: 80,
+			run: func(c *cache) {
+				c.add("a", "small", "small", wsconn.Payload{}, bytesOf(10), 0)
+				c.add("a", "big", "big", wsconn.Payload{}, bytesOf(11), 0)
+			},
+			want: []string{"a/small"},
+		},
+		{
+			name:    "replaced",
+			maxSize: 80,
+			run: func(c *cache) {
+				c.add("a", "1", "1", wsconn.Payload{}, bytesOf(10), 0)
+				c.add("a", "2", "2", wsconn.Payload{}, bytesOf(10), 0)
+				c.add("a", "1", "1", wsconn.Payload{}, bytesOf(5), 0)
+			},
+			want: []string{"a/1", "a/2"},
+		},
+		{
+			name:    "expired",
+			maxSize: 80,
+			ttl:     time.Millisecond,
+			run: func(c *cache) {
+				c.add("a", "1", "1", wsconn.Payload{}, bytesOf(10), 0)
+				time.Sleep(5 * time.Millisecond)
+				if _, ok := c.get("a", "1"); ok {
+					t.Error("got an expired entry")
+				}
+			},
+			want: []string{},
+		},
+		{
+			name:    "invalidated file",
+			maxSize: 80,
+			run: func(c *cache) {
+				c.add("a", "docs/", "docs/index.html", wsconn.Payload{}, bytesOf(10), 0)
+				c.add("a", "docs/index.html", "docs/index.html", wsconn.Payload{}, bytesOf(10), 0)
+				c.add("a", "other.html", "other.html", wsconn.Payload{}, bytesOf(10), 0)
+				c.add("b", "docs/index.html", "docs/index.html", wsconn.Payload{}, bytesOf(10), 0)
+				c.invalidate("a", "/docs/index.html")
+			},
+			want: []string{"b/docs/index.html", "a/other.html"},
+		},
+		{
+			name:    "invalidated request",
+			maxSize: 80,
+			run: func(c *cache) {
+				c.add("a", "docs/", "docs/index.html", wsconn.Payload{}, bytesOf(10), 0)
+				c.add("a", "other.html", "other.html", wsconn.Payload{}, bytesOf(10), 0)
+				c.invalidate("a", "docs/")
+			},
+			want: []string{"a/other.html"},
+		},
+		{
+			name:    "changed while fetched",
+			maxSize: 80,
+			run: func(c *cache) {
+				generation := c.begin()
+				c.invalidate("a", "docs/index.html")
+				c.add("a", "docs/", "docs/index.html", wsconn.Payload{}, bytesOf(10), generation)
+				c.done()
+			},
+			want: []string{},
+		},
+		{
+			name:    "requested path changed while fetched",
+			maxSize: 80,
+			run: func(c *cache) {
+				generation := c.begin()
+				c.invalidate("a", "docs/")
+				c.add("a", "docs/", "docs/index.html", wsconn.Payload{}, bytesOf(10), generation)
+				c.done()
+			},
+			want: []string{},
+		},
+		{
+			name:    "cleared while fetched",
+			maxSize: 80,
+			run: func(c *cache) {
+				generation := c.begin()
+				c.clear("a")
+				c.add("a", "1", "1", wsconn.Payload{}, bytesOf(10), generation)
+				c.done()
+			},
+			want: []string{},
+		},
+		{
+			name:    "other file changed while fetched",
+			maxSize: 80,
+			run: func(c *cache) {
+				generation := c.begin()
+				c.invalidate("a", "2")
+				c.invalidate("b", "1")
+				c.add("a", "1", "1", wsconn.Payload{}, bytesOf(10), generation)
+				c.done()
+			},
+			want: []string{"a/1"},
+		},
+		{
+			name:    "changed before fetched",
+			maxSize: 80,
+			run: func(c *cache) {
+				c.invalidate("a", "1")
+				generation := c.begin()
+				c.add("a", "1", "1", wsconn.Payload{}, bytesOf(10), generation)
+				c.done()
+			},
+			want: []string{"a/1"},
+		},
+		{
+			name:    "cleared",
+			maxSize: 80,
+			run: func(c *cache) {
+				c.add("a", "1", "1", wsconn.Payload{}, bytesOf(10), 0)
+				c.add("b", "1", "1", wsconn.Payload{}, bytesOf(10), 0)
+				c.add("a", "2", "2", wsconn.Payload{}, bytesOf(10), 0)
+				c.clear("a")
+			},
+			want: []string{"b/1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCache(tt.maxSize, tt.ttl)
+			tt.run(c)
+
+			got := []string{}
+			var size int64
+			for el := c.ll.Front(); el != nil; el = el.Next() {
+				e := el.Value.(*cacheEntry)
+				got = append(got, e.key)
+				size += int64(len(e.data))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if c.fetching != 0 || len(c.changed) != 0 {
+				t.Errorf("%d fetches and %d changes left", c.fetching, len(c.changed))
+			}
+			if len(c.items) != len(got) || c.size != size {
+				t.Errorf("%d items of %d bytes, but %d entries of %d bytes", len(c.items), c.size, len(got), size)
+			}
+		})
+	}
+}
+
+func TestCacheGet(t *testing.T) {
+	c := newCache(80, time.Hour)
+	c.add("a", "docs/", "docs/index.html", wsconn.Payload{
+		Status:  200,
+		Message: "data:,hello",
+		Body:    []byte("hello"),
+	}, []byte("hello"), 0)
+
+	e, ok := c.get("a", "docs/")
+	if !ok {
+		t.Fatal("not cached")
+	}
+	if e.path != "docs/index.html" || string(e.data) != "hello" || e.payload.Status != 200 {
+		t.Errorf("got %+v", e)
+	}
+	// the body is only kept once
+	if e.payload.Message != "" || e.payload.Body != nil {
+		t.Errorf("the payload kept its body: %+v", e.payload)
+	}
+	if _, ok := c.get("b", "docs/"); ok {
+		t.Error("got another domain's response")
+	}
+	if _, ok := c.get("a", "docs/index.html"); ok {
+		t.Error("got a response for a path that wasn't requested")
+	}
+}
+
+func TestCacheChangedWhileStreaming(t *testing.T) {
+	s := New("http://relay.test", "8001")
+	s.cache = newCache(1<<20, 0)
+	// the host says page.html changed between its two chunks
+	conn := hostConnection(t, "site", "key", func(ws *wsconn.WebsocketConn) {
+		for {
+			p, err := ws.Receive()
+			if err != nil {
+				return
+			}
+			if p.Type != "get" {
+				continue
+			}
+			ws.Send(wsconn.Payload{ID: p.ID, Type: "get", Success: true, Status: http.StatusOK, Chunked: true, Size: 10, Key: "key"})
+			ws.Send(wsconn.Payload{ID: p.ID, Type: "chunk", Success: true, Chunk: 0, Message: dataurl.EncodeBytes([]byte("hello")), Key: "key"})
+			if p.Message == "page.html" {
+				ws.Send(wsconn.Payload{Type: "invalidate", Message: "page.html", Key: "key"})
+			}
+			ws.Send(wsconn.Payload{ID: p.ID, Type: "chunk", Success: true, Chunk: 1, Done: true, Message: dataurl.EncodeBytes([]byte("world")), Key: "key"})
+		}
+	})
+	conn.invalidate = func(path string) {
+		s.cache.invalidate("site", path)
+	}
+	go conn.listen()
+	s.conn["site"] = []*connection{conn}
+
+	for _, tt := range []struct {
+		path   string
+		cached bool
+	}{
+		{path: "page.html", cached: false},
+		{path: "other.html", cached: true},
+	} {
+		w := httptest.NewRecorder()
+		s.handler(w, httptest.NewRequest("GET", "/site/"+tt.path, nil))
+		if w.Body.String() != "helloworld" {
+			t.Fatalf("%s: got %d %q", tt.path, w.Code, w.Body.String())
+		}
+		if _, ok := s.cache.get("site", tt.path); ok != tt.cached {
+			t.Errorf("%s: cached is %v, want %v", tt.path, ok, tt.cached)
+		}
+	}
+}
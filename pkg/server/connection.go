@@ -0,0 +1,462 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/schollz/hostyoself/pkg/wsconn"
+	log "github.com/schollz/logger"
+	"github.com/vincent-petithory/dataurl"
+)
+
+// connection determine what can be held
+type connection struct {
+	ID      int
+	Joined  time.Time
+	Domain  string
+	Key     string
+	LastGet string
+	Proxy   bool
+	ws      *wsconn.WebsocketConn
+
+	// Credentials are the hashed passwords by user that visitors
+	// need to see the domain, if there are any
+	Credentials map[string]string
+	// Secret checks the tokens signed by the host, which aren't
+	// taken if it is empty
+	Secret string
+	// Links are paths only served through signed links
+	Links []string
+	// Upload is set if the host saves files uploaded by visitors
+	Upload bool
+	// binary is set if the host takes chunks as binary frames
+	binary bool
+	// credit is set if the host waits for credit before sending
+	// more than wsconn.Window chunks of a response
+	credit bool
+
+	// invalidate is called when the host reports that a file changed
+	invalidate func(path string)
+
+	// pending holds the requests waiting on a response from
+	// the host, keyed by request ID
+	pending map[int64]*stream
+	closed  bool
+	// done is closed once the host disconnects
+	done chan struct{}
+	// legacy is set for hosts that don't advertise binary frames or
+	// credit in the handshake, which came before requests were
+	// multiplexed. Their requests are sent one at a time, holding serial.
+	legacy bool
+	serial chan struct{}
+	sync.Mutex
+}
+
+// stream carries the payloads of one response to its requester
+type stream struct {
+	ch   chan wsconn.Payload
+	done chan struct{}
+	// serial is set if the stream holds the connection's serial
+	serial bool
+}
+
+// errHostTimeout is returned when a host doesn't answer a request
+var errHostTimeout = errors.New("host did not answer in time")
+
+// responseTimeout is how long a host has to start answering a request
+var responseTimeout = 60 * time.Second
+
+// requestID is incremented for every request sent to a host
+var requestID int64
+
+// uploadChunkSize is the number of bytes of an upload sent in each chunk
+const uploadChunkSize = 64 * 1024
+
+// streamBuffer is the number of payloads held for a reader, which
+// is the response and a window of chunks. A stream that overflows
+// it is dropped rather than holding up the rest of the connection.
+const streamBuffer = wsconn.Window + 1
+
+// last returns whether p is the final payload of a response
+func last(p wsconn.Payload) bool {
+	if !p.Success {
+		return true
+	}
+	if p.Type == "chunk" {
+		return p.Done
+	}
+	return !p.Chunked
+}
+
+// listen reads payloads from the host and hands each one to the
+// request with the same ID
+func (c *connection) listen() (err error) {
+	defer func() {
+		c.Lock()
+		c.closed = true
+		for id, s := range c.pending {
+			close(s.ch)
+			delete(c.pending, id)
+		}
+		if c.done != nil {
+			close(c.done)
+		}
+		c.Unlock()
+	}()
+	for {
+		var p wsconn.Payload
+		p, err = c.ws.Receive()
+		if err != nil {
+			return
+		}
+		log.Tracef("recv: %+v", p)
+		if p.Type == "invalidate" {
+			if c.invalidate != nil {
+				c.invalidate(p.Message)
+			}
+			continue
+		}
+		c.Lock()
+		if p.ID == 0 {
+			// hosts that don't know about request IDs answer
+			// one request at a time, so this is the oldest
+			for id := range c.pending {
+				if p.ID == 0 || id < p.ID {
+					p.ID = id
+				}
+			}
+		}
+		s, ok := c.pending[p.ID]
+		if ok && last(p) {
+			delete(c.pending, p.ID)
+		}
+		c.Unlock()
+		if !ok {
+			log.Debugf("no request waiting for %s/%d/%d", c.Domain, c.ID, p.ID)
+			continue
+		}
+		select {
+		case s.ch <- p:
+		default:
+			// its reader is too slow, and the host is not
+			// waiting for credit
+			log.Debugf("dropping %s/%d/%d", c.Domain, c.ID, p.ID)
+			c.drop(p.ID, s)
+		}
+	}
+}
+
+// drop stops a stream whose reader can't keep up, which then
+// reads as if the connection closed
+func (c *connection) drop(id int64, s *stream) {
+	c.Lock()
+	_, ok := c.pending[id]
+	delete(c.pending, id)
+	c.Unlock()
+	if ok {
+		c.cancel(id)
+	}
+	close(s.ch)
+}
+
+// request sends a payload to the host and waits for the response
+// carrying the same request ID. If the host streams the response,
+// its body is returned as a reader which must be closed.
+func (c *connection) request(ctx context.Context, p wsconn.Payload) (r wsconn.Payload, body io.ReadCloser, err error) {
+	p.ID = atomic.AddInt64(&requestID, 1)
+	s := &stream{
+		ch:   make(chan wsconn.Payload, streamBuffer),
+		done: make(chan struct{}),
+	}
+	s.serial, err = c.wait(ctx)
+	if err != nil {
+		return
+	}
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		c.release(s)
+		err = fmt.Errorf("connection %s/%d is closed", c.Domain, c.ID)
+		return
+	}
+	c.pending[p.ID] = s
+	c.Unlock()
+	defer func() {
+		if body == nil {
+			c.finish(p.ID, s)
+		}
+	}()
+
+	err = c.ws.Send(p)
+	if err != nil {
+		return
+	}
+
+	timeout := time.NewTimer(responseTimeout)
+	defer timeout.Stop()
+	select {
+	case resp, ok := <-s.ch:
+		if !ok {
+			err = fmt.Errorf("connection %s/%d closed", c.Domain, c.ID)
+			return
+		}
+		r = resp
+	case <-timeout.C:
+		err = errHostTimeout
+		c.cancel(p.ID)
+		return
+	case <-ctx.Done():
+		err = ctx.Err()
+		c.cancel(p.ID)
+		return
+	}
+	if r.Success && r.Chunked {
+		body = &chunkReader{
+			ctx:  ctx,
+			conn: c,
+			id:   p.ID,
+			s:    s,
+			size: r.Size,
+		}
+	}
+	return
+}
+
+// upload announces a file to the host and streams it in chunks, then
+// waits for the host to say whether it was saved. The host may answer
+// early if it won't take the file.
+func (c *connection) upload(ctx context.Context, p wsconn.Payload, body io.Reader) (r wsconn.Payload, err error) {
+	p.ID = atomic.AddInt64(&requestID, 1)
+	s := &stream{
+		ch:   make(chan wsconn.Payload, 1),
+		done: make(chan struct{}),
+	}
+	s.serial, err = c.wait(ctx)
+	if err != nil {
+		return
+	}
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		c.release(s)
+		err = fmt.Errorf("connection %s/%d is closed", c.Domain, c.ID)
+		return
+	}
+	c.pending[p.ID] = s
+	c.Unlock()
+	defer c.finish(p.ID, s)
+
+	err = c.ws.Send(p)
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, uploadChunkSize)
+	for chunk := 0; ; chunk++ {
+		select {
+		case resp, ok := <-s.ch:
+			if !ok {
+				err = fmt.Errorf("connection %s/%d closed", c.Domain, c.ID)
+			}
+			r = resp
+			return
+		case <-ctx.Done():
+			err = ctx.Err()
+			c.cancel(p.ID)
+			return
+		default:
+		}
+
+		n, errRead := io.ReadFull(body, buf)
+		done := errRead == io.EOF || errRead == io.ErrUnexpectedEOF
+		if errRead != nil && !done {
+			err = errRead
+			c.cancel(p.ID)
+			return
+		}
+		chunkPayload := wsconn.Payload{
+			ID:      p.ID,
+			Type:    "chunk",
+			Success: true,
+			Chunk:   chunk,
+			Done:    done,
+		}
+		if c.binary {
+			chunkPayload.Data = buf[:n]
+			err = c.ws.SendBinary(chunkPayload)
+		} else {
+			if n > 0 {
+				chunkPayload.Message = dataurl.New(buf[:n], "application/octet-stream").String()
+			}
+			err = c.ws.Send(chunkPayload)
+		}
+		if err != nil {
+			return
+		}
+		if done {
+			break
+		}
+	}
+
+	timeout := time.NewTimer(responseTimeout)
+	defer timeout.Stop()
+	select {
+	case resp, ok := <-s.ch:
+		if !ok {
+			err = fmt.Errorf("connection %s/%d closed", c.Domain, c.ID)
+		}
+		r = resp
+	case <-timeout.C:
+		err = errHostTimeout
+		c.cancel(p.ID)
+	case <-ctx.Done():
+		err = ctx.Err()
+		c.cancel(p.ID)
+	}
+	return
+}
+
+// wait takes the connection's turn for a request if the host can
+// only answer one at a time, returning whether it did
+func (c *connection) wait(ctx context.Context) (serial bool, err error) {
+	if !c.legacy {
+		return
+	}
+	select {
+	case c.serial <- struct{}{}:
+		return true, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// release gives up the connection's turn if the stream holds it
+func (c *connection) release(s *stream) {
+	if s.serial {
+		<-c.serial
+	}
+}
+
+// finish stops routing payloads to a request
+func (c *connection) finish(id int64, s *stream) {
+	c.Lock()
+	delete(c.pending, id)
+	c.Unlock()
+	close(s.done)
+	c.release(s)
+}
+
+// cancel tells the host to stop sending a response
+func (c *connection) cancel(id int64) {
+	err := c.ws.Send(wsconn.Payload{
+		ID:   id,
+		Type: "cancel",
+	})
+	if err != nil {
+		log.Debug(err)
+	}
+}
+
+// grant lets the host send n more chunks of a response
+func (c *connection) grant(id int64, n int) {
+	err := c.ws.Send(wsconn.Payload{
+		ID:    id,
+		Type:  "credit",
+		Chunk: n,
+	})
+	if err != nil {
+		log.Debug(err)
+	}
+}
+
+// chunkReader reads a response body streamed by a host in chunks
+type chunkReader struct {
+	ctx  context.Context
+	conn *connection
+	id   int64
+	s    *stream
+	buf  []byte
+	next int
+	eof  bool
+	once sync.Once
+	// size is the length of the body if the host knew it
+	size int64
+	read int64
+}
+
+func (cr *chunkReader) Read(b []byte) (n int, err error) {
+	for len(cr.buf) == 0 {
+		if cr.eof {
+			return 0, io.EOF
+		}
+		select {
+		case p, ok := <-cr.s.ch:
+			if !ok {
+				return 0, fmt.Errorf("connection %s/%d closed", cr.conn.Domain, cr.conn.ID)
+			}
+			if !p.Success {
+				cr.eof = true
+				return 0, fmt.Errorf("host error: %s", p.Message)
+			}
+			if p.Type != "chunk" || p.Chunk != cr.next {
+				return 0, fmt.Errorf("expected chunk %d, got %s %d", cr.next, p.Type, p.Chunk)
+			}
+			cr.next++
+			cr.eof = p.Done
+			if cr.conn.credit && !cr.eof && cr.next%(wsconn.Window/2) == 0 {
+				// half the window has been read
+				cr.conn.grant(cr.id, wsconn.Window/2)
+			}
+			cr.buf, err = chunkData(p)
+			if err != nil {
+				return
+			}
+		case <-cr.ctx.Done():
+			return 0, cr.ctx.Err()
+		}
+	}
+	n = copy(b, cr.buf)
+	cr.buf = cr.buf[n:]
+	cr.read += int64(n)
+	if cr.size > 0 && cr.read >= cr.size && len(cr.buf) == 0 {
+		// everything is here, so there's no need to wait
+		// for the host to say it's done
+		cr.eof = true
+	}
+	return
+}
+
+// Close stops the stream, asking the host to stop sending if
+// the body was not read to the end
+func (cr *chunkReader) Close() error {
+	cr.once.Do(func() {
+		if !cr.eof {
+			cr.conn.cancel(cr.id)
+		}
+		cr.conn.finish(cr.id, cr.s)
+	})
+	return nil
+}
+
+// chunkData returns the bytes carried by a chunk, which hosts
+// without binary frames send as a data URL
+func chunkData(p wsconn.Payload) (b []byte, err error) {
+	if p.Data != nil {
+		b = p.Data
+		return
+	}
+	if p.Message == "" {
+		return
+	}
+	dataURL, err := dataurl.DecodeString(p.Message)
+	if err != nil {
+		return
+	}
+	b = dataURL.Data
+	return
+}
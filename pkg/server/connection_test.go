@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/schollz/hostyoself/pkg/wsconn"
+)
+
+func TestLegacyRequests(t *testing.T) {
+	// hosts from before request IDs answer without them, and
+	// may answer in any order if sent several requests at once
+	conn := hostConnection(t, "legacy", "key", func(ws *wsconn.WebsocketConn) {
+		var queued []wsconn.Payload
+		for {
+			p, err := ws.Receive()
+			if err != nil {
+				return
+			}
+			queued = append([]wsconn.Payload{p}, queued...)
+			for len(queued) > 0 {
+				err = ws.Send(wsconn.Payload{
+					Type:    "get",
+					Success: true,
+					Message: queued[0].Message,
+					Key:     "key",
+				})
+				if err != nil {
+					return
+				}
+				queued = queued[1:]
+			}
+		}
+	})
+	conn.legacy = true
+	go conn.listen()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			want := fmt.Sprintf("file%d", i)
+			p, _, err := conn.request(context.Background(), wsconn.Payload{Type: "get", Message: want})
+			if err != nil {
+				t.Error(err)
+			} else if p.Message != want {
+				t.Errorf("asked for %s, got %s", want, p.Message)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
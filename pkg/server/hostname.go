@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/schollz/hostyoself/pkg/utils"
+	"github.com/schollz/hostyoself/pkg/wsconn"
+	log "github.com/schollz/logger"
+)
+
+// resolver looks up the TXT records used to verify custom hostnames,
+// which is net.DefaultResolver unless stubbed out
+type resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// hostname is a custom hostname claimed by the owner of a domain.
+// Once verified it stays with the key that verified it while the domain
+// is connected or reserved, and only a TXT record can hand it to
+// someone else in the meantime.
+type hostname struct {
+	Domain   string
+	Key      string
+	Verified bool
+}
+
+// verifyAttempts is how many times a claim is checked before giving
+// up, waiting verifyInterval in between
+var (
+	verifyAttempts = 30
+	verifyInterval = time.Minute
+)
+
+// challengePath is where hosts serve the token for the challenge file
+const challengePath = "/.well-known/hostyoself/"
+
+// challengeClient fetches challenge files. Certificates aren't checked
+// since a hostname can't have one before it is verified, and the token
+// is what proves the claim. Nothing secret is sent with it.
+var challengeClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	},
+}
+
+// cleanHostname lowercases a Host header and drops its port
+func cleanHostname(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+// hostnameDomain returns the domain a request's Host header is mapped
+// to. Hostnames that are still being verified only serve the challenge file.
+func (s *server) hostnameDomain(r *http.Request) (domain string, ok bool) {
+	host := cleanHostname(r.Host)
+	if s.ownHostname(host) {
+		return
+	}
+	s.Lock()
+	h, found := s.hostnames[host]
+	found = found && s.active(h)
+	s.Unlock()
+	if !found {
+		return
+	}
+	if !h.Verified && !strings.HasPrefix(r.URL.Path, challengePath) {
+		return
+	}
+	return h.Domain, true
+}
+
+// ownHostname returns whether a hostname is the relay's own, or one
+// of its subdomains or addresses, which can't be claimed
+func (s *server) ownHostname(host string) bool {
+	if host == "localhost" || net.ParseIP(host) != nil {
+		return true
+	}
+	u, err := url.Parse(s.publicURL)
+	if err != nil {
+		return true
+	}
+	public := strings.ToLower(u.Hostname())
+	return host == public || strings.HasSuffix(host, "."+public)
+}
+
+// challenged returns whether a request is for the challenge file of a
+// claim for the domain that is being verified, which is let past the
+// domain's password. It only shows the token, which proves nothing
+// unless the relay fetched it through the hostname.
+func (s *server) challenged(r *http.Request, domain, prefix string) bool {
+	host := cleanHostname(r.Host)
+	s.Lock()
+	h, ok := s.hostnames[host]
+	s.Unlock()
+	if !ok || h.Verified || h.Domain != domain {
+		return false
+	}
+	return strings.TrimPrefix(r.URL.Path, prefix) == challengePath+utils.VerificationToken(h.Domain, h.Key, host)
+}
+
+// claimHostname starts verifying a custom hostname for the domain of a
+// connection, retrying until it works or the connection closes
+func (s *server) claimHostname(conn *connection, host string) {
+	host = cleanHostname(host)
+	if s.ownHostname(host) {
+		s.notifyHostname(conn, host, false, fmt.Sprintf("%s belongs to the relay and can't be claimed", host))
+		return
+	}
+	s.Lock()
+	s.pruneHostnames()
+	h, found := s.hostnames[host]
+	mine := found && h.Domain == conn.Domain && h.Key == conn.Key
+	if mine && h.Verified {
+		s.Unlock()
+		s.notifyHostname(conn, host, true, fmt.Sprintf("serving %s at %s", conn.Domain, s.hostnameURL(host)))
+		return
+	}
+	// a hostname someone else verified, is using or may come back
+	// to keeps working for them until the new claim is verified, and
+	// only DNS can verify it. The challenge file only shows that the
+	// hostname points at the relay, not who it belongs to.
+	taken := found && !mine && (h.Verified || s.active(h) || s.returning(h))
+	if !taken {
+		s.hostnames[host] = hostname{Domain: conn.Domain, Key: conn.Key}
+	}
+	s.Unlock()
+	s.verifyHostname(conn, host, taken)
+}
+
+// active returns whether the owner of a hostname is connected, which
+// must be called while locked
+func (s *server) active(h hostname) bool {
+	return len(s.conn[h.Domain]) > 0 && s.conn[h.Domain][0].Key == h.Key
+}
+
+// returning returns whether the domain of the owner of a hostname is
+// still reserved for them, which must be called while locked
+func (s *server) returning(h hostname) bool {
+	r, ok := s.reserved[h.Domain]
+	return ok && r.Key == h.Key && time.Now().Before(r.Expires)
+}
+
+// pruneHostnames forgets the hostnames of owners that are neither
+// connected nor reserved, which must be called while locked
+func (s *server) pruneHostnames() {
+	for host, h := range s.hostnames {
+		if !s.active(h) && !s.returning(h) {
+			delete(s.hostnames, host)
+		}
+	}
+}
+
+// dropClaim forgets a claim that was not verified, unless someone
+// else has claimed the hostname since
+func (s *server) dropClaim(conn *connection, host string) {
+	s.Lock()
+	defer s.Unlock()
+	h, ok := s.hostnames[host]
+	if ok && !h.Verified && h.Domain == conn.Domain && h.Key == conn.Key {
+		delete(s.hostnames, host)
+	}
+}
+
+// verifyHostname checks a claim until it works, it runs out of
+// attempts or the connection closes, and drops the claim unless it worked
+func (s *server) verifyHostname(conn *connection, host string, dnsOnly bool) {
+	token := utils.VerificationToken(conn.Domain, conn.Key, host)
+	for i := 0; i < verifyAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(verifyInterval):
+			case <-conn.done:
+			}
+		}
+		conn.Lock()
+		closed := conn.closed
+		conn.Unlock()
+		if closed {
+			s.dropClaim(conn, host)
+			return
+		}
+
+		byDNS := s.verifyTXT(host, token)
+		if !byDNS && (dnsOnly || !s.verifyChallenge(host, token)) {
+			if i == 0 {
+				s.notifyHostname(conn, host, false, fmt.Sprintf("waiting for %s to be verified", host))
+			}
+			continue
+		}
+
+		s.Lock()
+		s.hostnames[host] = hostname{
+			Domain:   conn.Domain,
+			Key:      conn.Key,
+			Verified: true,
+		}
+		s.Unlock()
+		log.Infof("%s verified for %s", host, conn.Domain)
+		s.notifyHostname(conn, host, true, fmt.Sprintf("serving %s at %s", conn.Domain, s.hostnameURL(host)))
+		return
+	}
+	s.dropClaim(conn, host)
+	s.notifyHostname(conn, host, false, fmt.Sprintf("could not verify %s", host))
+}
+
+// hostnameURL returns the public URL of a custom hostname, which uses
+// the same scheme and port as the relay
+func (s *server) hostnameURL(host string) string {
+	u, err := url.Parse(s.publicURL)
+	if err != nil {
+		return "http://" + host + "/"
+	}
+	port := u.Port()
+	u.Host = host
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	}
+	u.Path = "/"
+	return u.String()
+}
+
+// verifyTXT looks for the token in the TXT records of _hostyoself.hostname
+func (s *server) verifyTXT(host, token string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	records, err := s.resolver.LookupTXT(ctx, "_hostyoself."+host)
+	if err != nil {
+		log.Debugf("no TXT record for %s: %s", host, err.Error())
+		return false
+	}
+	for _, record := range records {
+		if strings.TrimSpace(record) == "hostyoself-verification="+token {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyChallenge fetches the challenge file through the hostname,
+// which only reaches the host if the hostname points at the relay
+func (s *server) verifyChallenge(host, token string) bool {
+	challengeURL := s.challengeURL(host)
+	if challengeURL == "" {
+		return false
+	}
+	resp, err := challengeClient.Get(challengeURL + strings.TrimPrefix(challengePath, "/") + token)
+	if err != nil {
+		log.Debugf("could not fetch challenge for %s: %s", host, err.Error())
+		return false
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return false
+	}
+	return resp.StatusCode == http.StatusOK && strings.TrimSpace(string(b)) == token
+}
+
+// challengeURL returns where challenge files of a hostname are fetched,
+// or nothing if they can't be. With ACME that is over plain HTTP, since
+// there is no certificate for the hostname until it is verified.
+func (s *server) challengeURL(host string) string {
+	if s.ACME == nil {
+		return s.hostnameURL(host)
+	}
+	if s.ACME.HTTPPort == "" {
+		return ""
+	}
+	if s.ACME.HTTPPort != "80" {
+		host = net.JoinHostPort(host, s.ACME.HTTPPort)
+	}
+	return "http://" + host + "/"
+}
+
+// notifyHostname tells a host how its claim is going
+func (s *server) notifyHostname(conn *connection, host string, success bool, message string) {
+	log.Debugf("%s/%s: %s", conn.Domain, host, message)
+	err := conn.ws.Send(wsconn.Payload{
+		Type:     "hostname",
+		Hostname: host,
+		Success:  success,
+		Message:  message,
+	})
+	if err != nil {
+		log.Debug(err)
+	}
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/schollz/hostyoself/pkg/utils"
+	"github.com/schollz/hostyoself/pkg/wsconn"
+)
+
+// stubResolver answers TXT lookups from a map
+type stubResolver map[string][]string
+
+func (r stubResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, fmt.Errorf("no such host")
+	}
+	return records, nil
+}
+
+// answerChallenges stands in for a hostname that points at the
+// relay, where whoever claims it answers the challenge file
+type answerChallenges struct{}
+
+func (answerChallenges) RoundTrip(r *http.Request) (*http.Response, error) {
+	token := strings.TrimPrefix(r.URL.Path, challengePath)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader(token)),
+		Request:    r,
+	}, nil
+}
+
+// testConnection returns a connection for a domain whose host
+// ignores what it is sent
+func testConnection(t *testing.T, domain, key string) *connection {
+	return hostConnection(t, domain, key, func(ws *wsconn.WebsocketConn) {
+		for {
+			if _, err := ws.Receive(); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// hostConnection returns a connection for a domain whose host is
+// played by the host function, which has the host's end of the websocket
+func hostConnection(t *testing.T, domain, key string, host func(ws *wsconn.WebsocketConn)) *connection {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := wsupgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		host(wsconn.New(c))
+	}))
+	t.Cleanup(ts.Close)
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return &connection{
+		Domain:  domain,
+		Key:     key,
+		ws:      wsconn.New(c),
+		pending: make(map[int64]*stream),
+		serial:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+func TestClaimHostname(t *testing.T) {
+	defer func(attempts int, interval time.Duration, transport http.RoundTripper) {
+		verifyAttempts, verifyInterval, challengeClient.Transport = attempts, interval, transport
+	}(verifyAttempts, verifyInterval, challengeClient.Transport)
+	verifyAttempts = 2
+	verifyInterval = time.Millisecond
+	challengeClient.Transport = answerChallenges{}
+
+	const host = "www.example.com"
+	owner := hostname{Domain: "owner", Key: "ownerkey"}
+	tests := []struct {
+		name string
+		// host is claimed instead of www.example.com if set
+		host string
+		// existing is the claim already on the hostname, if any
+		existing *hostname
+		// online and reserved say whether the owner is connected
+		// or its domain is reserved for it
+		online   bool
+		reserved bool
+		// txt is set if the claimant adds a TXT record
+		txt  bool
+		want hostname
+	}{
+		{
+			name: "new claim",
+			want: hostname{Domain: "other", Key: "otherkey", Verified: true},
+		},
+		{
+			name:     "verified owner online",
+			existing: &hostname{Domain: owner.Domain, Key: owner.Key, Verified: true},
+			online:   true,
+			want:     hostname{Domain: owner.Domain, Key: owner.Key, Verified: true},
+		},
+		{
+			name:     "verified owner reserved",
+			existing: &hostname{Domain: owner.Domain, Key: owner.Key, Verified: true},
+			reserved: true,
+			want:     hostname{Domain: owner.Domain, Key: owner.Key, Verified: true},
+		},
+		{
+			name:     "verified owner reserved with TXT",
+			existing: &hostname{Domain: owner.Domain, Key: owner.Key, Verified: true},
+			reserved: true,
+			txt:      true,
+			want:     hostname{Domain: "other", Key: "otherkey", Verified: true},
+		},
+		{
+			name:     "verified owner gone",
+			existing: &hostname{Domain: owner.Domain, Key: owner.Key, Verified: true},
+			want:     hostname{Domain: "other", Key: "otherkey", Verified: true},
+		},
+		{
+			name:     "unverified owner online",
+			existing: &owner,
+			online:   true,
+			want:     owner,
+		},
+		{
+			name:     "unverified owner reserved",
+			existing: &owner,
+			reserved: true,
+			want:     owner,
+		},
+		{
+			name:     "unverified owner gone",
+			existing: &owner,
+			want:     hostname{Domain: "other", Key: "otherkey", Verified: true},
+		},
+		{
+			name: "relay's hostname",
+			host: "relay.test",
+		},
+		{
+			name: "relay's subdomain",
+			host: "owner.relay.test",
+		},
+		{
+			name: "relay's address",
+			host: "127.0.0.1",
+		},
+		{
+			name: "localhost",
+			host: "localhost",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("http://relay.test", "8001")
+			resolver := stubResolver{}
+			s.resolver = resolver
+			if tt.existing != nil {
+				s.hostnames[host] = *tt.existing
+			}
+			if tt.online {
+				s.conn[owner.Domain] = []*connection{testConnection(t, owner.Domain, owner.Key)}
+			}
+			if tt.reserved {
+				s.reserved[owner.Domain] = reservation{Key: owner.Key, Expires: time.Now().Add(gracePeriod)}
+			}
+			conn := testConnection(t, "other", "otherkey")
+			if tt.txt {
+				resolver["_hostyoself."+host] = []string{
+					"hostyoself-verification=" + utils.VerificationToken(conn.Domain, conn.Key, host),
+				}
+			}
+
+			claimed := host
+			if tt.host != "" {
+				claimed = tt.host
+			}
+			s.claimHostname(conn, claimed)
+			if got := s.hostnames[claimed]; got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// refuseChallenges stands in for a hostname that doesn't point at the relay
+type refuseChallenges struct{}
+
+func (refuseChallenges) RoundTrip(r *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusNotFound,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    r,
+	}, nil
+}
+
+func TestClaimDroppedOnClose(t *testing.T) {
+	defer func(attempts int, interval time.Duration, transport http.RoundTripper) {
+		verifyAttempts, verifyInterval, challengeClient.Transport = attempts, interval, transport
+	}(verifyAttempts, verifyInterval, challengeClient.Transport)
+	verifyAttempts = 30
+	verifyInterval = time.Hour
+	challengeClient.Transport = refuseChallenges{}
+
+	const host = "www.example.com"
+	s := New("http://relay.test", "8001")
+	s.resolver = stubResolver{}
+	leave := make(chan struct{})
+	conn := hostConnection(t, "site", "key", func(ws *wsconn.WebsocketConn) {
+		<-leave
+	})
+	s.conn["site"] = []*connection{conn}
+	go conn.listen()
+
+	finished := make(chan struct{})
+	go func() {
+		s.claimHostname(conn, host)
+		close(finished)
+	}()
+	claimed := func() bool {
+		s.Lock()
+		defer s.Unlock()
+		_, ok := s.hostnames[host]
+		return ok
+	}
+	for deadline := time.Now().Add(time.Second); !claimed(); {
+		if time.Now().After(deadline) {
+			t.Fatal("hostname was not claimed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(leave)
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("verification kept running after the connection closed")
+	}
+	if claimed() {
+		t.Errorf("claim was kept: %+v", s.hostnames[host])
+	}
+}
+
+func TestHostnamesPruned(t *testing.T) {
+	s := New("http://relay.test", "8001")
+	s.conn["online"] = []*connection{testConnection(t, "online", "key")}
+	s.reserved["reserved"] = reservation{Key: "key", Expires: time.Now().Add(gracePeriod)}
+	s.reserved["expired"] = reservation{Key: "key", Expires: time.Now().Add(-time.Second)}
+	for _, domain := range []string{"online", "reserved", "expired", "gone"} {
+		s.hostnames[domain+".example.com"] = hostname{Domain: domain, Key: "key", Verified: true}
+	}
+	// someone else reconnected to the domain of the last one
+	s.hostnames["taken.example.com"] = hostname{Domain: "online", Key: "otherkey", Verified: true}
+
+	s.Lock()
+	err := s.checkOwner("new", "key")
+	s.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"online.example.com", "reserved.example.com"} {
+		if _, ok := s.hostnames[host]; !ok {
+			t.Errorf("%s was forgotten", host)
+		}
+	}
+	for _, host := range []string{"expired.example.com", "gone.example.com", "taken.example.com"} {
+		if _, ok := s.hostnames[host]; ok {
+			t.Errorf("%s was kept", host)
+		}
+	}
+}
+
+func TestHostnameRouting(t *testing.T) {
+	s := New("http://relay.test", "8001")
+	s.conn["site"] = []*connection{echoHost(t, "site", "key")}
+	s.hostnames["www.example.com"] = hostname{Domain: "site", Key: "key", Verified: true}
+	// claims on the relay's own hostname from before they were refused
+	s.hostnames["relay.test"] = hostname{Domain: "site", Key: "key", Verified: true}
+
+	tests := []struct {
+		host string
+		path string
+		// site is set if the request should reach the site
+		site bool
+	}{
+		{host: "www.example.com", path: "/index.html", site: true},
+		{host: "www.example.com", path: "/ws"},
+		{host: "relay.test", path: "/"},
+		{host: "relay.test", path: "/ws"},
+		{host: "relay.test:8001", path: "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host+tt.path, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			s.handler(w, r)
+			if site := w.Header().Get("X-Path") != ""; site != tt.site {
+				t.Errorf("reached the site: %v, want %v (status %d)", site, tt.site, w.Code)
+			}
+		})
+	}
+}
+
+func TestChallengeURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		publicURL string
+		acme      *ACME
+		want      string
+	}{
+		{name: "http", publicURL: "http://relay.test:8010", want: "http://www.example.com:8010/"},
+		{name: "https", publicURL: "https://relay.test", want: "https://www.example.com/"},
+		{name: "acme", publicURL: "https://relay.test", acme: &ACME{HTTPPort: "80"}, want: "http://www.example.com/"},
+		{name: "acme on another port", publicURL: "https://relay.test", acme: &ACME{HTTPPort: "8080"}, want: "http://www.example.com:8080/"},
+		{name: "acme without http", publicURL: "https://relay.test", acme: &ACME{}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(tt.publicURL, "443")
+			s.ACME = tt.acme
+			if got := s.challengeURL("www.example.com"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
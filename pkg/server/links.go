@@ -0,0 +1,171 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/schollz/hostyoself/pkg/utils"
+)
+
+// errLinkOnly refuses files that are only shared through links to
+// visitors without one
+var errLinkOnly = errors.New("this file is only shared through links")
+
+// download counts how often a link was used until it expires
+type download struct {
+	Count   int
+	Expires time.Time
+}
+
+// checkLink lets in visitors with a signed link minted by the hosts of
+// a domain, counting each download. Paths the hosts only share through
+// links are refused without one. It returns whether the request came
+// with a link and whether it may go on, and the signature of the link
+// if the download was counted, which is given back with uncount if the
+// file is not sent after all.
+func (s *server) checkLink(w http.ResponseWriter, r *http.Request, domain, prefix string) (linked, ok bool, counted string) {
+	connections := s.connections(domain)
+	if len(connections) == 0 {
+		return false, true, ""
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+	q := r.URL.Query()
+	signature := q.Get("signature")
+	if signature == "" {
+		if s.linkOnly(domain, path) {
+			http.Error(w, errLinkOnly.Error(), http.StatusForbidden)
+			return false, false, ""
+		}
+		return false, true, ""
+	}
+
+	expires, _ := strconv.ParseInt(q.Get("expires"), 10, 64)
+	downloads, _ := strconv.Atoi(q.Get("downloads"))
+	if !signedLink(connections, domain, path, signature, expires, downloads) {
+		http.Error(w, "bad link", http.StatusForbidden)
+		return true, false, ""
+	}
+	if expires != 0 && time.Now().Unix() > expires {
+		http.Error(w, "link expired", http.StatusGone)
+		return true, false, ""
+	}
+
+	// only downloads count, not checking whether there is one
+	if downloads > 0 && r.Method != http.MethodHead {
+		s.Lock()
+		now := time.Now()
+		for sig, d := range s.downloads {
+			if !d.Expires.IsZero() && now.After(d.Expires) {
+				delete(s.downloads, sig)
+			}
+		}
+		d := s.downloads[signature]
+		if d.Count >= downloads {
+			s.Unlock()
+			http.Error(w, "link used up", http.StatusGone)
+			return true, false, ""
+		}
+		d.Count++
+		if expires != 0 {
+			d.Expires = time.Unix(expires, 0)
+		}
+		s.downloads[signature] = d
+		s.Unlock()
+		counted = signature
+	}
+
+	// the link is for the relay, not the host
+	q.Del("signature")
+	q.Del("expires")
+	q.Del("downloads")
+	r.URL.RawQuery = q.Encode()
+	return true, true, counted
+}
+
+// signedLink returns whether a link was signed by any host of a
+// domain. Hosts without a secret don't sign links.
+func signedLink(connections []*connection, domain, path, signature string, expires int64, downloads int) bool {
+	for _, c := range connections {
+		if c.Secret != "" && equal(signature, utils.SignLink(domain, c.Secret, path, expires, downloads)) {
+			return true
+		}
+	}
+	return false
+}
+
+// linkOnly returns whether a path of a domain is one its hosts only
+// share through links, however the path is written
+func (s *server) linkOnly(domain, p string) bool {
+	connections := s.connections(domain)
+	if len(connections) == 0 {
+		return false
+	}
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	for _, l := range connections[0].Links {
+		if l == p {
+			return true
+		}
+	}
+	return false
+}
+
+// unlinked drops the files a domain only shares through links from
+// a list of its files, for hosts that list them anyway
+func (s *server) unlinked(domain string, fs []File) []File {
+	kept := fs[:0]
+	for _, f := range fs {
+		if !s.linkOnly(domain, f.name()) {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// uncount gives back a download of a link whose file was not sent
+func (s *server) uncount(signature string) {
+	s.Lock()
+	defer s.Unlock()
+	if d, ok := s.downloads[signature]; ok && d.Count > 0 {
+		d.Count--
+		s.downloads[signature] = d
+	}
+}
+
+// linkWriter follows a response to a signed link to tell whether the
+// file was downloaded, which is as soon as it starts being sent. Each
+// part of it that is asked for, as when a download is resumed, is a
+// download of its own.
+type linkWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (lw *linkWriter) WriteHeader(status int) {
+	if lw.status == 0 {
+		lw.status = status
+	}
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *linkWriter) Write(b []byte) (int, error) {
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	return lw.ResponseWriter.Write(b)
+}
+
+func (lw *linkWriter) Flush() {
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// downloaded returns whether the file, or part of it, was sent
+func (lw *linkWriter) downloaded() bool {
+	return lw.status == http.StatusOK || lw.status == http.StatusPartialContent
+}
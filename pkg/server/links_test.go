@@ -0,0 +1,158 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/schollz/hostyoself/pkg/utils"
+	"github.com/schollz/hostyoself/pkg/wsconn"
+	"github.com/vincent-petithory/dataurl"
+)
+
+// signed returns the URL of a link to a file of the site
+func signed(secret, path string, expires int64, downloads int) string {
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("downloads", strconv.Itoa(downloads))
+	q.Set("signature", utils.SignLink("site", secret, path, expires, downloads))
+	return "/site/" + path + "?" + q.Encode()
+}
+
+func TestLinks(t *testing.T) {
+	const secret = "secret"
+	files := map[string]bool{"secret.zip": true, "docs/index.html": true, "public.txt": true, "bin/tool": true}
+	conn := hostConnection(t, "site", "key", func(ws *wsconn.WebsocketConn) {
+		for {
+			p, err := ws.Receive()
+			if err != nil {
+				return
+			}
+			resp := wsconn.Payload{ID: p.ID, Type: p.Type, Key: "key"}
+			if files[p.Message] {
+				resp.Success = true
+				resp.Status = http.StatusOK
+				if p.Header.Get("Range") != "" {
+					resp.Status = http.StatusPartialContent
+				}
+			}
+			ws.Send(resp)
+		}
+	})
+	go conn.listen()
+	conn.Secret = secret
+	conn.Links = []string{"secret.zip", "docs/index.html", "missing.zip", "bin/tool"}
+	s := New("http://relay.test", "8001")
+	s.conn["site"] = []*connection{conn}
+
+	expired := time.Now().Add(-time.Hour).Unix()
+	// the steps share the server, so downloads add up along the way
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		// rng is sent as the Range header if set
+		rng  string
+		want int
+		// location is where a redirect should go, if set
+		location string
+	}{
+		{name: "other file", path: "/site/public.txt", want: http.StatusOK},
+		{name: "link-only file", path: "/site/secret.zip", want: http.StatusForbidden},
+		{name: "trailing slash", path: "/site/secret.zip/", want: http.StatusForbidden},
+		{name: "dot segment", path: "/site/./secret.zip", want: http.StatusForbidden},
+		{name: "index of folder", path: "/site/docs/", want: http.StatusForbidden},
+		{name: "folder without slash", path: "/site/docs?sort=size", want: http.StatusFound, location: "/site/docs/?sort=size"},
+		{name: "link-only file without extension", path: "/site/bin/tool", want: http.StatusForbidden},
+		{name: "link to file without extension", path: signed(secret, "bin/tool", 0, 0), want: http.StatusOK},
+		{name: "link", path: signed(secret, "secret.zip", 0, 2), want: http.StatusOK},
+		{name: "checking the link", method: http.MethodHead, path: signed(secret, "secret.zip", 0, 2), want: http.StatusOK},
+		{name: "range of the link", path: signed(secret, "secret.zip", 0, 2), rng: "bytes=0-9", want: http.StatusPartialContent},
+		{name: "used up link", path: signed(secret, "secret.zip", 0, 2), want: http.StatusGone},
+		{name: "used up range", path: signed(secret, "secret.zip", 0, 2), rng: "bytes=10-", want: http.StatusGone},
+		{name: "link to folder", path: signed(secret, "docs/", 0, 0), want: http.StatusOK},
+		{name: "link to missing file", path: signed(secret, "missing.zip", 0, 1), want: http.StatusNotFound},
+		{name: "missing file isn't used up", path: signed(secret, "missing.zip", 0, 1), want: http.StatusNotFound},
+		{name: "expired link", path: signed(secret, "secret.zip", expired, 0), want: http.StatusGone},
+		{name: "link signed with the key", path: signed("key", "secret.zip", 0, 0), want: http.StatusForbidden},
+		{name: "link for another file", path: "/site/secret.zip" + signed(secret, "public.txt", 0, 0)[len("/site/public.txt"):], want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, tt.path, nil)
+			if tt.rng != "" {
+				r.Header.Set("Range", tt.rng)
+			}
+			w := httptest.NewRecorder()
+			s.handler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got %d, want %d", w.Code, tt.want)
+			}
+			if location := w.Header().Get("Location"); location != tt.location {
+				t.Errorf("redirected to %q, want %q", location, tt.location)
+			}
+		})
+	}
+
+	// links minted by any host of the site work
+	second := echoHost(t, "site", "key")
+	second.Secret = "other"
+	s.conn["site"] = []*connection{conn, second}
+	w := httptest.NewRecorder()
+	s.handler(w, httptest.NewRequest("GET", signed("other", "secret.zip", 0, 0), nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d for a link of the second host, want %d", w.Code, http.StatusOK)
+	}
+	s.conn["site"] = []*connection{conn}
+
+	// hosts without a secret have no links
+	conn.Secret = ""
+	w = httptest.NewRecorder()
+	s.handler(w, httptest.NewRequest("GET", signed("", "secret.zip", 0, 0), nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d for a link without a secret, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestLinksNotCached(t *testing.T) {
+	conn := hostConnection(t, "site", "key", func(ws *wsconn.WebsocketConn) {
+		for {
+			p, err := ws.Receive()
+			if err != nil {
+				return
+			}
+			resp := wsconn.Payload{ID: p.ID, Type: p.Type, Key: "key"}
+			if p.Message == "docs/index.html" {
+				resp.Success = true
+				resp.Status = http.StatusOK
+				resp.Size = 5
+				resp.Message = dataurl.EncodeBytes([]byte("hello"))
+			}
+			ws.Send(resp)
+		}
+	})
+	go conn.listen()
+	conn.Secret = "secret"
+	conn.Links = []string{"docs/index.html"}
+	s := New("http://relay.test", "8001")
+	s.conn["site"] = []*connection{conn}
+	s.cache = newCache(1<<20, time.Minute)
+
+	w := httptest.NewRecorder()
+	s.handler(w, httptest.NewRequest("GET", signed("secret", "docs/", 0, 0), nil))
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("got %d %q through the link", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	s.handler(w, httptest.NewRequest("GET", "/site/docs/", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d without the link, want %d", w.Code, http.StatusForbidden)
+	}
+}
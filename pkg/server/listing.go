@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/schollz/logger"
+)
+
+// entry is a file or folder in the listing of a folder
+type entry struct {
+	Name string `json:"name"`
+	// Path is relative to the site, ending in a slash for folders
+	Path string `json:"path"`
+	// Size is in bytes, the total of the files in it for a folder,
+	// and Modified in Unix seconds
+	Size     int64 `json:"size"`
+	Modified int64 `json:"modified,omitempty"`
+	IsDir    bool  `json:"isDir"`
+}
+
+// HumanSize is the size to show in the listing
+func (e entry) HumanSize() string {
+	size := float64(e.Size)
+	for _, unit := range []string{"B", "kB", "MB", "GB"} {
+		if size < 1000 || unit == "GB" {
+			if unit == "B" {
+				return fmt.Sprintf("%d B", e.Size)
+			}
+			return fmt.Sprintf("%.1f %s", size, unit)
+		}
+		size /= 1000
+	}
+	return ""
+}
+
+// Time is the modification time to show in the listing
+func (e entry) Time() string {
+	if e.Modified == 0 {
+		return ""
+	}
+	return time.Unix(e.Modified, 0).UTC().Format("2006-01-02 15:04")
+}
+
+// crumb links to a folder above the one listed
+type crumb struct {
+	Name string
+	URL  string
+}
+
+// name returns the path of a file, which hosts in the browser
+// may only send as the name of the upload
+func (f File) name() string {
+	if f.FullPath != "" {
+		return f.FullPath
+	}
+	return f.Upload.Filename
+}
+
+// entries returns the files and folders directly in folder, which
+// is empty or ends in a slash. Folders are found from the paths of
+// the files in them for hosts that don't send them.
+func entries(fs []File, folder string) (es []entry) {
+	dirs := make(map[string]int)
+	dir := func(name string) *entry {
+		if i, ok := dirs[name]; ok {
+			return &es[i]
+		}
+		dirs[name] = len(es)
+		es = append(es, entry{Name: name, Path: folder + name + "/", IsDir: true})
+		return &es[len(es)-1]
+	}
+	for _, f := range fs {
+		name := f.name()
+		if !strings.HasPrefix(name, folder) || name == folder {
+			continue
+		}
+		rest := strings.TrimPrefix(name, folder)
+		if i := strings.Index(rest, "/"); i >= 0 {
+			// files further down count towards their folder
+			if !f.IsDir {
+				dir(rest[:i]).Size += f.Size
+			}
+		} else if f.IsDir {
+			dir(rest).Modified = f.Modified
+		} else {
+			es = append(es, entry{
+				Name:     rest,
+				Path:     name,
+				Size:     f.Size,
+				Modified: f.Modified,
+			})
+		}
+	}
+	return
+}
+
+// sortEntries orders entries by name, size or modified, keeping
+// folders before files
+func sortEntries(es []entry, by string, desc bool) {
+	sort.SliceStable(es, func(i, j int) bool {
+		if es[i].IsDir != es[j].IsDir {
+			return es[i].IsDir
+		}
+		a, b := es[i], es[j]
+		if desc {
+			a, b = b, a
+		}
+		switch by {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "modified":
+			if a.Modified != b.Modified {
+				return a.Modified < b.Modified
+			}
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+}
+
+// listing shows the files and folders in a folder of a domain, as
+// a page or as JSON for requests that accept it
+func (s *server) listing(w http.ResponseWriter, r *http.Request, domain, prefix, folder string, fs []File) (err error) {
+	es := entries(fs, folder)
+	if len(es) == 0 && folder != "" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil
+	}
+
+	by := r.URL.Query().Get("sort")
+	if by != "size" && by != "modified" {
+		by = "name"
+	}
+	desc := r.URL.Query().Get("order") == "desc"
+	sortEntries(es, by, desc)
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		if es == nil {
+			es = []entry{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(es)
+	}
+
+	crumbs := []crumb{{Name: domain, URL: prefix + "/"}}
+	url := prefix + "/"
+	for _, dir := range strings.Split(strings.TrimSuffix(folder, "/"), "/") {
+		if dir == "" {
+			continue
+		}
+		url += dir + "/"
+		crumbs = append(crumbs, crumb{Name: dir, URL: url})
+	}
+
+	b, _ := Asset("templates/files.html")
+	t, err := template.New("files").Parse(string(b))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	return t.Execute(w, struct {
+		Entries []entry
+		Crumbs  []crumb
+		Domain  string
+		Prefix  string
+		Sort    string
+		Desc    bool
+		Upload  bool
+	}{
+		Entries: es,
+		Crumbs:  crumbs,
+		Domain:  domain,
+		Prefix:  prefix,
+		Sort:    by,
+		Desc:    desc,
+		Upload:  s.acceptsUploads(domain),
+	})
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListing(t *testing.T) {
+	s := New("http://relay.test", "8001")
+	conn := echoHost(t, "site", "key")
+	conn.Links = []string{"files/secret.zip"}
+	s.conn["site"] = []*connection{conn}
+
+	t.Run("entries", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/site/files/", nil)
+		r.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		s.handler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d, want %d", w.Code, http.StatusOK)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("got Content-Type %q, want application/json", got)
+		}
+		var got []entry
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		want := []entry{
+			{Name: "docs", Path: "files/docs/", Size: 110, IsDir: true},
+			{Name: "A.txt", Path: "files/A.txt", Size: 200, Modified: 3000},
+			{Name: "b.txt", Path: "files/b.txt", Size: 300, Modified: 1000},
+			{Name: "c.txt", Path: "files/c.txt", Size: 100, Modified: 2000},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+
+	tests := []struct {
+		name  string
+		query string
+		// want is the names of the entries in order, or nothing
+		// if the folder is not found
+		want []string
+	}{
+		{name: "by name", want: []string{"docs", "A.txt", "b.txt", "c.txt"}},
+		{name: "by name descending", query: "?order=desc", want: []string{"docs", "c.txt", "b.txt", "A.txt"}},
+		{name: "by size", query: "?sort=size", want: []string{"docs", "c.txt", "A.txt", "b.txt"}},
+		{name: "by size descending", query: "?sort=size&order=desc", want: []string{"docs", "b.txt", "A.txt", "c.txt"}},
+		{name: "by modified", query: "?sort=modified", want: []string{"docs", "b.txt", "c.txt", "A.txt"}},
+		{name: "by modified descending", query: "?sort=modified&order=desc", want: []string{"docs", "A.txt", "c.txt", "b.txt"}},
+		{name: "by something else", query: "?sort=color", want: []string{"docs", "A.txt", "b.txt", "c.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/site/files/"+tt.query, nil)
+			r.Header.Set("Accept", "application/json")
+			w := httptest.NewRecorder()
+			s.handler(w, r)
+			var es []entry
+			if err := json.Unmarshal(w.Body.Bytes(), &es); err != nil {
+				t.Fatalf("%d %q: %s", w.Code, w.Body.String(), err)
+			}
+			var got []string
+			for _, e := range es {
+				got = append(got, e.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("subfolder", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/site/files/docs/", nil)
+		r.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		s.handler(w, r)
+		var got []entry
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%d %q: %s", w.Code, w.Body.String(), err)
+		}
+		want := []entry{
+			{Name: "guide.md", Path: "files/docs/guide.md", Size: 50, Modified: 4000},
+			{Name: "notes.md", Path: "files/docs/notes.md", Size: 60, Modified: 5000},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("missing folder", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		s.handler(w, httptest.NewRequest("GET", "/site/files/none/", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("got %d, want %d", w.Code, http.StatusNotFound)
+		}
+	})
+
+	t.Run("page", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		s.handler(w, httptest.NewRequest("GET", "/site/files/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d, want %d", w.Code, http.StatusOK)
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, "A.txt") {
+			t.Errorf("A.txt is not in the page")
+		}
+		if strings.Contains(body, "secret.zip") {
+			t.Errorf("the link-only file is in the page")
+		}
+	})
+}
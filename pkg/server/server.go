@@ -1,12 +1,20 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,23 +28,56 @@ import (
 	"github.com/vincent-petithory/dataurl"
 )
 
+// maxRequestBody is the largest request body forwarded to a host
+const maxRequestBody = 32 << 20
+
+// gracePeriod is how long a domain stays reserved for its key
+// after the last host disconnects
+const gracePeriod = 5 * time.Minute
+
 type server struct {
 	publicURL string
 	port      string
 
+	// Subdomains serves each domain at domain.publichost
+	// instead of publichost/domain
+	Subdomains bool
+
+	// CacheSize is the most bytes of responses kept in memory and
+	// CacheTTL is how long they are kept. Nothing is cached if
+	// CacheSize is zero.
+	CacheSize int64
+	CacheTTL  time.Duration
+	cache     *cache
+
+	// TLSCert and TLSKey are files with the certificate used to
+	// serve HTTPS, or ACME gets the certificate automatically
+	TLSCert string
+	TLSKey  string
+	ACME    *ACME
+	// certs holds when a certificate was asked for by subdomain
+	certs map[string]time.Time
+
+	// hostnames maps custom hostnames to the domains that claimed
+	// them, checking claims with resolver
+	hostnames map[string]hostname
+	resolver  resolver
+
 	// connections stored as map of domain -> connections
-	conn map[string][]*connection
+	conn   map[string][]*connection
+	nextID int
+	// reserved stores domains without connections that
+	// can only be rejoined with the same key for a while
+	reserved map[string]reservation
+	// downloads counts the uses of signed links by signature
+	downloads map[string]download
 	sync.Mutex
 }
 
-// connection determine what can be held
-type connection struct {
-	ID      int
-	Joined  time.Time
-	Domain  string
+// reservation holds a domain for its key until it expires
+type reservation struct {
 	Key     string
-	LastGet string
-	ws      *wsconn.WebsocketConn
+	Expires time.Time
 }
 
 func New(publicURL, port string) *server {
@@ -44,13 +85,37 @@ func New(publicURL, port string) *server {
 		publicURL: publicURL,
 		port:      port,
 		conn:      make(map[string][]*connection),
+		reserved:  make(map[string]reservation),
+		hostnames: make(map[string]hostname),
+		downloads: make(map[string]download),
+		certs:     make(map[string]time.Time),
+		resolver:  net.DefaultResolver,
 	}
 }
 
 func (s *server) Run() (err error) {
-	log.Infof("listening on :%s", s.port)
+	if s.CacheSize > 0 {
+		log.Infof("caching up to %d bytes for %s", s.CacheSize, s.CacheTTL)
+		s.cache = newCache(s.CacheSize, s.CacheTTL)
+	}
 	http.HandleFunc("/", s.handler)
-	return http.ListenAndServe(fmt.Sprintf(":%s", s.port), nil)
+	srv := &http.Server{Addr: fmt.Sprintf(":%s", s.port)}
+
+	// websockets are upgraded on the same listener, so HTTPS
+	// gives secure websockets too
+	if s.ACME != nil {
+		srv.TLSConfig, err = s.tlsConfig()
+		if err != nil {
+			return
+		}
+		log.Infof("listening on :%s with ACME certificates", s.port)
+		return srv.ListenAndServeTLS("", "")
+	} else if s.TLSCert != "" {
+		log.Infof("listening on :%s with TLS", s.port)
+		return srv.ListenAndServeTLS(s.TLSCert, s.TLSKey)
+	}
+	log.Infof("listening on :%s", s.port)
+	return srv.ListenAndServe()
 }
 
 func (s *server) handler(w http.ResponseWriter, r *http.Request) {
@@ -66,13 +131,24 @@ func (s *server) handler(w http.ResponseWriter, r *http.Request) {
 func (s *server) handle(w http.ResponseWriter, r *http.Request) (err error) {
 	log.Debugf("URL: %s, Referer: %s", r.URL.Path, r.Referer())
 
+	// hosts connect to the relay itself wherever they come from
+	if r.URL.Path == "/ws" {
+		return s.handleWebsocket(w, r)
+	}
+	// everything else on a subdomain belongs to its site
+	if domain, ok := s.subdomain(r); ok {
+		return s.handleDomain(w, r, domain, "")
+	}
+	// and so does everything on a custom hostname
+	if domain, ok := s.hostnameDomain(r); ok {
+		return s.handleDomain(w, r, domain, "")
+	}
+
 	// very special paths
 	if r.URL.Path == "/robots.txt" {
 		// special path
 		w.Write([]byte(`User-agent: * 
 Disallow:`))
-	} else if r.URL.Path == "/ws" {
-		return s.handleWebsocket(w, r)
 	} else if r.URL.Path == "/favicon.ico" {
 		err = fmt.Errorf("not implemented")
 		return
@@ -116,13 +192,6 @@ Disallow:`))
 			GeneratedKey:    utils.RandStringBytesMaskImpr(6),
 		})
 	} else {
-		// get IP address
-		var ipAddress string
-		ipAddress, err = utils.GetClientIPHelper(r)
-		if err != nil {
-			log.Debugf("could not determine ip: %s", err.Error())
-		}
-
 		log.Debugf("attempting to find %s", r.URL.Path)
 
 		// determine file path and the domain
@@ -130,6 +199,15 @@ Disallow:`))
 		domain := strings.Split(r.URL.Path[1:], "/")[0]
 		// clean domain
 		domain = strings.Replace(strings.ToLower(strings.TrimSpace(domain)), " ", "-", -1)
+		if s.Subdomains {
+			// sites live on their own subdomain
+			if !s.isdomain(domain) {
+				err = fmt.Errorf("not found")
+				return
+			}
+			http.Redirect(w, r, s.domainURL(domain)+strings.TrimPrefix(strings.TrimPrefix(pathToFile, domain), "/"), 302)
+			return
+		}
 		if !s.isdomain(domain) {
 			log.Debugf("getting referer")
 			// if there is a referer, try to obtain the domain from referer
@@ -150,110 +228,216 @@ Disallow:`))
 			return
 		}
 
-		// add slash if doesn't exist
-		if filepath.Ext(pathToFile) == "" && string(r.URL.Path[len(r.URL.Path)-1]) != "/" {
-			http.Redirect(w, r, r.URL.Path+"/", 302)
+		return s.handleDomain(w, r, domain, "/"+domain)
+	}
+	return
+}
+
+// handleDomain serves a request for a site from its hosts. The site's
+// URLs start with prefix, which is empty when it has its own subdomain.
+func (s *server) handleDomain(w http.ResponseWriter, r *http.Request, domain, prefix string) (err error) {
+	// get IP address
+	var ipAddress string
+	ipAddress, err = utils.GetClientIPHelper(r)
+	if err != nil {
+		log.Debugf("could not determine ip: %s", err.Error())
+	}
+
+	// signed links work on protected domains too
+	linked, ok, counted := s.checkLink(w, r, domain, prefix)
+	if !ok || (!linked && !s.authorize(w, r, domain, prefix)) {
+		return
+	}
+	if counted != "" {
+		// the download doesn't count unless the file is sent
+		lw := &linkWriter{ResponseWriter: w}
+		w = lw
+		defer func() {
+			if !lw.downloaded() {
+				s.uncount(counted)
+			}
+		}()
+	}
+
+	urlPath := strings.TrimPrefix(r.URL.Path, prefix)
+	if r.Method == http.MethodPost && s.acceptsUploads(domain) &&
+		strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return s.upload(w, r, domain, prefix, urlPath, ipAddress)
+	}
+	if s.isproxy(domain) {
+		return s.forward(w, r, domain, prefix, ipAddress)
+	}
+
+	// whole folders can be downloaded at once
+	if format := archiveFormat(r, urlPath); format != "" {
+		return s.archive(w, r, domain, urlPath, format, ipAddress)
+	}
+
+	// add slash if doesn't exist, except to challenge files and files
+	// shared through links, which may have no extension
+	if filepath.Ext(urlPath) == "" && !strings.HasSuffix(r.URL.Path, "/") && !strings.HasPrefix(urlPath, challengePath) &&
+		!linked && !s.linkOnly(domain, urlPath) {
+		target := r.URL.Path + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, 302)
+		return
+	}
+
+	// trim prefix to get the path to file
+	pathToFile := strings.TrimPrefix(urlPath, "/")
+	if pathToFile == "" {
+		pathToFile = "index.html"
+	}
+	log.Debugf("pathToFile: %s", pathToFile)
+
+	// popular files may not need to bother the host
+	requested := pathToFile
+	if s.cache != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		if e, ok := s.cache.get(domain, requested); ok {
+			log.Debugf("%s/%s from cache", domain, requested)
+			s.serveCached(w, r, prefix, e)
 			return
 		}
+	}
+
+	// everything about the request is passed on to the host
+	var req wsconn.Payload
+	req, err = newRequest(r, ipAddress)
+	if err == errBodyTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return nil
+	} else if err != nil {
+		return
+	}
 
-		// trim prefix to get the path to file
-		pathToFile = strings.TrimPrefix(pathToFile, domain)
-		if len(pathToFile) == 0 || string(pathToFile[0]) == "/" {
-			if len(pathToFile) <= 1 {
-				pathToFile = "index.html"
-			} else {
-				pathToFile = pathToFile[1:]
+	// a response fetched now isn't kept if its file changes meanwhile
+	var generation uint64
+	if s.cache != nil && !linked && r.Method == http.MethodGet {
+		generation = s.cache.begin()
+		defer s.cache.done()
+	}
+
+	// send GET request to websockets, where files only shared through
+	// links are refused without one whichever path finds them
+	get := func(pathToFile string) (wsconn.Payload, io.ReadCloser, error) {
+		if !linked && s.linkOnly(domain, pathToFile) {
+			return wsconn.Payload{}, nil, hostError{status: http.StatusForbidden, message: errLinkOnly.Error()}
+		}
+		return s.get(r.Context(), domain, pathToFile, req)
+	}
+	var resp wsconn.Payload
+	var body io.ReadCloser
+	var fs []File
+	resp, body, err = get(pathToFile)
+	if notFound(err) {
+		// try index.html if it doesn't exist
+		if filepath.Ext(pathToFile) == "" {
+			if string(pathToFile[len(pathToFile)-1]) != "/" {
+				pathToFile += "/"
 			}
+			pathToFile += "index.html"
+			log.Debugf("trying 2nd try to get: %s", pathToFile)
+			resp, body, err = get(pathToFile)
 		}
-		log.Debugf("pathToFile: %s", pathToFile)
-
-		// send GET request to websockets
-		var data string
-		var fs []File
-		data, err = s.get(domain, pathToFile, ipAddress)
-		if err != nil {
-			// try index.html if it doesn't exist
-			if filepath.Ext(pathToFile) == "" {
-				if string(pathToFile[len(pathToFile)-1]) != "/" {
-					pathToFile += "/"
-				}
-				pathToFile += "index.html"
-				log.Debugf("trying 2nd try to get: %s", pathToFile)
-				data, err = s.get(domain, pathToFile, ipAddress)
+		if notFound(err) {
+			// try one more time
+			if strings.HasSuffix(pathToFile, "/index.html") {
+				pathToFile = strings.TrimSuffix(pathToFile, "/index.html")
+				log.Debugf("trying 3rd try to get: %s", pathToFile)
+				resp, body, err = get(pathToFile)
 			}
-			if err != nil {
-				// try one more time
-				if strings.HasSuffix(pathToFile, "/index.html") {
-					pathToFile = strings.TrimSuffix(pathToFile, "/index.html")
-					log.Debugf("trying 3rd try to get: %s", pathToFile)
-					data, err = s.get(domain, pathToFile, ipAddress)
-				}
-				if err != nil {
-					if pathToFile == "index.html" {
-						// just serve files
-						fs, err = s.getFiles(domain, ipAddress)
-						log.Debugf("fs: %+v", fs)
-						if err != nil {
-							log.Debug(err)
-							return
-						}
-
-						b, _ := Asset("templates/files.html")
-						var t *template.Template
-						t, err = template.New("files").Parse(string(b))
-						if err != nil {
-							log.Error(err)
-							return
-						}
-						return t.Execute(w, struct {
-							Files  []File
-							Domain string
-						}{
-							Domain: domain,
-							Files:  fs,
-						})
-					} else {
-						log.Debugf("problem getting: %s", err.Error())
-						err = fmt.Errorf("not found")
-						return
-					}
+			if notFound(err) && (requested == "index.html" || strings.HasSuffix(requested, "/")) {
+				// just serve files
+				fs, err = s.getFiles(r.Context(), domain, ipAddress)
+				log.Debugf("fs: %+v", fs)
+				if err == errHostTimeout {
+					http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+					return nil
+				} else if err != nil {
+					log.Debug(err)
+					return
 				}
+				return s.listing(w, r, domain, prefix, strings.TrimSuffix(requested, "index.html"), fs)
 			}
 		}
-
-		// decode the data URI
-		var dataURL *dataurl.DataURL
-		dataURL, err = dataurl.DecodeString(data)
-		if err != nil {
-			log.Errorf("problem decoding '%s': %s", data, err.Error())
-			return
+	}
+	if err != nil {
+		log.Debugf("problem getting: %s", err.Error())
+		status := http.StatusNotFound
+		if err == errHostTimeout {
+			status = http.StatusGatewayTimeout
+		} else if he, ok := err.(hostError); ok && he.status != 0 {
+			status = he.status
+			writeHeader(w, prefix, wsconn.Payload{Header: he.header})
 		}
+		http.Error(w, http.StatusText(status), status)
+		return nil
+	}
 
-		// determine the content type
-		var contentType string
-		switch filepath.Ext(pathToFile) {
-		case ".css":
-			contentType = "text/css"
-		case ".js":
-			contentType = "text/javascript"
-		case ".html":
-			contentType = "text/html"
-		}
-		if contentType == "" {
-			contentType = dataURL.MediaType.ContentType()
-			if contentType == "application/octet-stream" || contentType == "" {
-				pathToFileExt := filepath.Ext(pathToFile)
-				mimeType := filetype.GetType(pathToFileExt)
+	defer body.Close()
+
+	// determine the content type
+	var contentType string
+	switch filepath.Ext(pathToFile) {
+	case ".css":
+		contentType = "text/css"
+	case ".js":
+		contentType = "text/javascript"
+	case ".html":
+		contentType = "text/html"
+	}
+	if contentType == "" {
+		contentType = resp.ContentType
+		if contentType == "application/octet-stream" || contentType == "" {
+			pathToFileExt := strings.TrimPrefix(filepath.Ext(pathToFile), ".")
+			mimeType := filetype.GetType(pathToFileExt)
+			if mimeType.MIME.Value != "" {
 				contentType = mimeType.MIME.Value
 			}
 		}
-		log.Debugf("%s/%s (%s)", domain, pathToFile, contentType)
+	}
+	log.Debugf("%s/%s (%s)", domain, pathToFile, contentType)
 
-		// write the data to the requester
-		w.Header().Set("Content-Type", contentType)
-		w.Write(dataURL.Data)
+	// the host may not have checked whether the visitor's copy is current
+	if resp.Status == http.StatusOK && (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+		utils.NotModified(r.Header, resp.ETag, modified(resp)) {
+		resp.Status = http.StatusNotModified
+		resp.Size = 0
+		writeHeader(w, prefix, resp)
+		w.WriteHeader(resp.Status)
 		return
 	}
+
+	// keep a copy of the response while it streams if it can be cached,
+	// unless it was reached through a link and may be a file only
+	// shared through one
+	var cached *bytes.Buffer
+	if s.cache != nil && !linked && r.Method == http.MethodGet && cacheable(resp, s.cache.maxEntry()) {
+		cached = new(bytes.Buffer)
+		body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(body, cached), body}
+	}
+
+	// stream the data to the requester
+	writeHeader(w, prefix, resp)
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.Status)
+	_, err = copyFlush(w, body)
+	if err != nil {
+		// headers are already sent, so all that can be done
+		// is to cut the response short
+		log.Debugf("problem streaming %s/%s: %s", domain, pathToFile, err.Error())
+		err = nil
+	} else if cached != nil && int64(cached.Len()) == resp.Size {
+		resp.ContentType = contentType
+		s.cache.add(domain, requested, pathToFile, resp, cached.Bytes(), generation)
+	}
 	return
 }
 
@@ -293,19 +477,70 @@ func (s *server) handleWebsocket(w http.ResponseWriter, r *http.Request) (err er
 
 	domain := strings.Replace(strings.ToLower(strings.TrimSpace(p.Message)), " ", "-", -1)
 
-	// create domain if it doesn't exist
+	if s.Subdomains && !validSubdomain.MatchString(domain) {
+		log.Debugf("invalid subdomain %s", domain)
+		err = ws.Send(wsconn.Payload{
+			Type:    "domain",
+			Message: fmt.Sprintf("domain '%s' can't be used as a subdomain", domain),
+			Success: false,
+		})
+		if err != nil {
+			log.Debug(err)
+		}
+		ws.Close()
+		return nil
+	}
+
+	// only the key that owns a domain may join it
 	s.Lock()
+	errOwner := s.checkOwner(domain, p.Key)
+	if errOwner != nil {
+		s.Unlock()
+		log.Debug(errOwner)
+		err = ws.Send(wsconn.Payload{
+			Type:    "domain",
+			Message: errOwner.Error(),
+			Success: false,
+		})
+		if err != nil {
+			log.Debug(err)
+		}
+		ws.Close()
+		return nil
+	}
+	delete(s.reserved, domain)
+
+	// create domain if it doesn't exist
 	if _, ok := s.conn[domain]; !ok {
 		s.conn[domain] = []*connection{}
 	}
 	// register the new connection in the domain
-	s.conn[domain] = append(s.conn[domain], &connection{
-		ID:     len(s.conn[domain]),
-		Domain: domain,
-		Joined: time.Now(),
-		Key:    p.Key,
-		ws:     ws,
-	})
+	s.nextID++
+	conn := &connection{
+		ID:          s.nextID,
+		Domain:      domain,
+		Joined:      time.Now(),
+		Key:         p.Key,
+		Proxy:       p.Proxy,
+		Credentials: p.Credentials,
+		Secret:      p.Secret,
+		Links:       p.Links,
+		Upload:      p.Upload,
+		binary:      p.Binary,
+		credit:      p.Credit,
+		legacy:      !p.Binary && !p.Credit,
+		ws:          ws,
+		pending:     make(map[int64]*stream),
+		serial:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		invalidate: func(path string) {
+			if s.cache != nil {
+				log.Debugf("invalidating %s/%s", domain, path)
+				s.cache.invalidate(domain, path)
+			}
+		},
+	}
+	s.conn[domain] = append(s.conn[domain], conn)
 	log.Debugf("added: %+v", s.conn)
 	s.Unlock()
 
@@ -313,23 +548,103 @@ func (s *server) handleWebsocket(w http.ResponseWriter, r *http.Request) (err er
 		Type:    "domain",
 		Message: domain,
 		Success: true,
+		Binary:  p.Binary,
+		Credit:  p.Credit,
+		URL:     s.domainURL(domain),
 	})
 	if err != nil {
 		log.Error(err)
 	}
+	if p.Hostname != "" {
+		go s.claimHostname(conn, p.Hostname)
+	}
+
+	// route responses to the requests waiting on them until
+	// the host disconnects
+	err = conn.listen()
+	log.Debugf("%s/%d disconnected: %s", domain, conn.ID, err)
+	s.dumpConnection(domain, conn.ID)
+	ws.Close()
 	return nil
 }
 
+// validSubdomain matches domains that can be used as a DNS label
+var validSubdomain = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// subdomain returns the domain of a request to domain.publichost
+func (s *server) subdomain(r *http.Request) (domain string, ok bool) {
+	if !s.Subdomains {
+		return
+	}
+	u, err := url.Parse(s.publicURL)
+	if err != nil {
+		return
+	}
+	host := strings.ToLower(r.Host)
+	if h, _, errSplit := net.SplitHostPort(host); errSplit == nil {
+		host = h
+	}
+	suffix := "." + strings.ToLower(u.Hostname())
+	if !strings.HasSuffix(host, suffix) {
+		return
+	}
+	domain = strings.TrimSuffix(host, suffix)
+	ok = validSubdomain.MatchString(domain)
+	return
+}
+
+// domainURL returns the public URL of a domain
+func (s *server) domainURL(domain string) string {
+	if s.Subdomains {
+		u, err := url.Parse(s.publicURL)
+		if err == nil {
+			u.Host = domain + "." + u.Host
+			u.Path = "/"
+			return u.String()
+		}
+	}
+	return s.publicURL + "/" + domain + "/"
+}
+
 func (s *server) isdomain(domain string) bool {
 	s.Lock()
-	_, ok := s.conn[domain]
+	ok := len(s.conn[domain]) > 0
 	s.Unlock()
 	return ok
 }
 
+// checkOwner returns an error if the domain is held by another key,
+// either by its current hosts or by a reservation that hasn't expired.
+// It must be called with the server locked.
+func (s *server) checkOwner(domain, key string) (err error) {
+	now := time.Now()
+	for d, r := range s.reserved {
+		if now.After(r.Expires) {
+			delete(s.reserved, d)
+		}
+	}
+	s.pruneHostnames()
+
+	owner := ""
+	if connections := s.conn[domain]; len(connections) > 0 {
+		owner = connections[0].Key
+	} else if r, ok := s.reserved[domain]; ok {
+		owner = r.Key
+	}
+	if owner != "" && owner != key {
+		err = fmt.Errorf("domain '%s' is already in use by another key", domain)
+	}
+	return
+}
+
 type File struct {
 	FullPath string `json:"fullPath"`
 	Upload   Upload `json:"upload"`
+	// Size is in bytes and Modified in Unix seconds, if the host
+	// knows them. Folders are only sent by some hosts.
+	Size     int64 `json:"size,omitempty"`
+	Modified int64 `json:"modified,omitempty"`
+	IsDir    bool  `json:"isDir,omitempty"`
 }
 type Upload struct {
 	UUID     string `json:"uuid"`
@@ -337,14 +652,18 @@ type Upload struct {
 	Filename string `json:"filename"`
 }
 
-func (s *server) getFiles(domain, ipAddress string) (fs []File, err error) {
-	var connections []*connection
+// connections returns a copy of the connections of a domain
+func (s *server) connections(domain string) (connections []*connection) {
 	s.Lock()
-	if _, ok := s.conn[domain]; ok {
-		connections = s.conn[domain]
-	}
-	s.Unlock()
-	if connections == nil || len(connections) == 0 {
+	defer s.Unlock()
+	connections = make([]*connection, len(s.conn[domain]))
+	copy(connections, s.conn[domain])
+	return
+}
+
+func (s *server) getFiles(ctx context.Context, domain, ipAddress string) (fs []File, err error) {
+	connections := s.connections(domain)
+	if len(connections) == 0 {
 		err = fmt.Errorf("no connections available for domain %s", domain)
 		log.Debug(err)
 		return
@@ -355,22 +674,22 @@ func (s *server) getFiles(domain, ipAddress string) (fs []File, err error) {
 	key := connections[0].Key
 
 	// loop through connections randomly and try to get one to serve the file
+	timedOut := false
 	for _, i := range rand.Perm(len(connections)) {
 		var p wsconn.Payload
-		p, err = func() (p wsconn.Payload, err error) {
-			err = connections[i].ws.Send(wsconn.Payload{
-				Type:      "files",
-				Message:   "all",
-				IPAddress: ipAddress,
-			})
-			if err != nil {
-				return
-			}
-			p, err = connections[i].ws.Receive()
-			return
-		}()
+		p, _, err = connections[i].request(ctx, wsconn.Payload{
+			Type:      "files",
+			Message:   "all",
+			IPAddress: ipAddress,
+		})
 		if err != nil {
 			log.Debug(err)
+			if ctx.Err() != nil {
+				return
+			}
+			if err == errHostTimeout {
+				timedOut = true
+			}
 			s.dumpConnection(domain, connections[i].ID)
 			continue
 		}
@@ -382,65 +701,348 @@ func (s *server) getFiles(domain, ipAddress string) (fs []File, err error) {
 			}
 
 			err = json.Unmarshal([]byte(p.Message), &fs)
+			fs = s.unlinked(domain, fs)
 			return
 		}
 		log.Debugf("no good data from %d", i)
 	}
 	err = fmt.Errorf("invalid response")
+	if timedOut {
+		err = errHostTimeout
+	}
 	return
 }
 
-func (s *server) get(domain, filePath, ipAddress string) (payload string, err error) {
-	var connections []*connection
-	s.Lock()
-	if _, ok := s.conn[domain]; ok {
-		connections = s.conn[domain]
+// get requests a file from the host. The body of the response is
+// always returned as a reader which must be closed.
+func (s *server) get(ctx context.Context, domain, filePath string, req wsconn.Payload) (p wsconn.Payload, body io.ReadCloser, err error) {
+	req.Type = "get"
+	req.Message = filePath
+	return s.request(ctx, domain, req)
+}
+
+// errBodyTooLarge is returned for request bodies over maxRequestBody
+var errBodyTooLarge = fmt.Errorf("request body too large")
+
+// newRequest describes a visitor's request to send on to a host
+func newRequest(r *http.Request, ipAddress string) (p wsconn.Payload, err error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestBody+1))
+	if err != nil {
+		return
 	}
-	s.Unlock()
-	if connections == nil || len(connections) == 0 {
+	if len(body) > maxRequestBody {
+		err = errBodyTooLarge
+		return
+	}
+	p = wsconn.Payload{
+		Type:      "get",
+		IPAddress: ipAddress,
+		Method:    r.Method,
+		Query:     r.URL.RawQuery,
+		Header:    utils.RemoveHopHeaders(r.Header),
+		Body:      body,
+	}
+	if r.Method == http.MethodGet {
+		p.Range = parseRange(r.Header.Get("Range"))
+		if p.Range != nil {
+			p.Range.IfRange = r.Header.Get("If-Range")
+		}
+	}
+	return
+}
+
+// parseRange reads a Range header with a single byte range, returning
+// nil for anything else so that the whole file is sent
+func parseRange(h string) (r *wsconn.Range) {
+	if !strings.HasPrefix(h, "bytes=") || strings.Contains(h, ",") {
+		return
+	}
+	spec := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(h, "bytes=")), "-", 2)
+	if len(spec) != 2 {
+		return
+	}
+	if spec[0] == "" {
+		// the last n bytes
+		n, err := strconv.ParseInt(spec[1], 10, 64)
+		if err != nil || n <= 0 {
+			return
+		}
+		return &wsconn.Range{Start: -n, End: -1}
+	}
+	start, err := strconv.ParseInt(spec[0], 10, 64)
+	if err != nil || start < 0 {
+		return
+	}
+	end := int64(-1)
+	if spec[1] != "" {
+		end, err = strconv.ParseInt(spec[1], 10, 64)
+		if err != nil || end < start {
+			return
+		}
+	}
+	return &wsconn.Range{Start: start, End: end}
+}
+
+// hostError is a failure reported by a host, with the
+// HTTP status it gave if any
+type hostError struct {
+	status  int
+	header  http.Header
+	message string
+}
+
+func (e hostError) Error() string {
+	return e.message
+}
+
+// notFound returns whether err means the host doesn't have
+// what was asked for
+func notFound(err error) bool {
+	if err == nil || err == errHostTimeout {
+		return false
+	}
+	he, ok := err.(hostError)
+	return !ok || he.status == 0 || he.status == http.StatusNotFound
+}
+
+// originHeaders apply to every site on the relay's origin, which
+// hosts may only send when their site has an origin of its own
+var originHeaders = map[string]bool{
+	"Alt-Svc":                   true,
+	"Clear-Site-Data":           true,
+	"Service-Worker-Allowed":    true,
+	"Strict-Transport-Security": true,
+}
+
+// writeHeader sets the headers of a host's response, keeping
+// redirects and cookies within the site's prefix
+func writeHeader(w http.ResponseWriter, prefix string, p wsconn.Payload) {
+	for k, vv := range utils.RemoveHopHeaders(p.Header) {
+		k = http.CanonicalHeaderKey(k)
+		if k == "Content-Length" || (prefix != "" && originHeaders[k]) {
+			continue
+		}
+		for _, v := range vv {
+			if k == "Set-Cookie" {
+				var ok bool
+				v, ok = scopeCookie(v, prefix)
+				if !ok {
+					continue
+				}
+			}
+			w.Header().Add(k, v)
+		}
+	}
+	if location := w.Header().Get("Location"); strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+		w.Header().Set("Location", prefix+location)
+	}
+	if p.ETag != "" {
+		w.Header().Set("ETag", p.ETag)
+	}
+	if p.Modified != 0 {
+		w.Header().Set("Last-Modified", time.Unix(p.Modified, 0).UTC().Format(http.TimeFormat))
+	}
+	if p.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(p.Size, 10))
+	}
+}
+
+// scopeCookie keeps a cookie set by a host to its own site, dropping
+// its domain and putting its path under the site's prefix. It returns
+// false for cookies that can't be read.
+func scopeCookie(v, prefix string) (string, bool) {
+	cookies := (&http.Response{Header: http.Header{"Set-Cookie": []string{v}}}).Cookies()
+	if len(cookies) != 1 {
+		return "", false
+	}
+	c := cookies[0]
+	c.Domain = ""
+	if prefix != "" {
+		if !strings.HasPrefix(c.Path, "/") {
+			c.Path = "/"
+		}
+		c.Path = prefix + c.Path
+	}
+	v = c.String()
+	return v, v != ""
+}
+
+// cacheable returns whether a host's response can be kept for
+// other visitors
+func cacheable(p wsconn.Payload, maxSize int64) bool {
+	if p.Status != http.StatusOK || p.Size <= 0 || p.Size > maxSize {
+		return false
+	}
+	if p.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	cacheControl := strings.ToLower(p.Header.Get("Cache-Control"))
+	return !strings.Contains(cacheControl, "no-store") && !strings.Contains(cacheControl, "private")
+}
+
+// serveCached writes a response from the cache, which takes care
+// of ranges and conditional requests on its own
+func (s *server) serveCached(w http.ResponseWriter, r *http.Request, prefix string, e *cacheEntry) {
+	p := e.payload
+	p.Size = 0
+	writeHeader(w, prefix, p)
+	if p.ContentType != "" {
+		w.Header().Set("Content-Type", p.ContentType)
+	}
+	http.ServeContent(w, r, e.path, modified(p), bytes.NewReader(e.data))
+}
+
+// modified returns the modification time reported by a host
+func modified(p wsconn.Payload) (t time.Time) {
+	if p.Modified != 0 {
+		t = time.Unix(p.Modified, 0)
+	}
+	return
+}
+
+// request sends a "get" payload to one of the hosts of a domain. The
+// body of the response is always returned as a reader which must be closed.
+func (s *server) request(ctx context.Context, domain string, req wsconn.Payload) (p wsconn.Payload, body io.ReadCloser, err error) {
+	connections := s.connections(domain)
+	if len(connections) == 0 {
 		err = fmt.Errorf("no connections available for domain %s", domain)
 		log.Debug(err)
 		return
 	}
-	log.Debugf("requesting %s/%s from %d connections", domain, filePath, len(connections))
+	log.Debugf("requesting %s/%s from %d connections", domain, req.Message, len(connections))
 
 	// any connection that initated with this key is viable
 	key := connections[0].Key
 
 	// loop through connections randomly and try to get one to serve the file
+	timedOut := false
 	for _, i := range rand.Perm(len(connections)) {
-		var p wsconn.Payload
-		p, err = func() (p wsconn.Payload, err error) {
-			err = connections[i].ws.Send(wsconn.Payload{
-				Type:      "get",
-				Message:   filePath,
-				IPAddress: ipAddress,
-			})
-			if err != nil {
-				return
-			}
-			p, err = connections[i].ws.Receive()
-			return
-		}()
+		p, body, err = connections[i].request(ctx, req)
 		if err != nil {
 			log.Debug(err)
+			if ctx.Err() != nil {
+				return
+			}
+			if err == errHostTimeout {
+				timedOut = true
+			}
 			s.dumpConnection(domain, connections[i].ID)
 			continue
 		}
 		log.Tracef("recv: %+v", p)
 		if p.Type == "get" && p.Key == key {
-			payload = p.Message
 			if !p.Success {
-				err = fmt.Errorf(payload)
+				err = hostError{status: p.Status, header: p.Header, message: p.Message}
+				return
+			}
+			if p.Status == 0 {
+				p.Status = http.StatusOK
+			}
+			if body == nil && p.Message == "" {
+				// nothing to send, as for a redirect
+				body = ioutil.NopCloser(bytes.NewReader(nil))
+			} else if body == nil {
+				// hosts that don't stream send the whole file
+				// as a single data URL
+				var dataURL *dataurl.DataURL
+				dataURL, err = dataurl.DecodeString(p.Message)
+				if err != nil {
+					log.Errorf("problem decoding '%s': %s", req.Message, err.Error())
+					return
+				}
+				if p.ContentType == "" {
+					p.ContentType = dataURL.MediaType.ContentType()
+				}
+				p.Size = int64(len(dataURL.Data))
+				body = ioutil.NopCloser(bytes.NewReader(dataURL.Data))
 			}
 			return
 		}
+		if body != nil {
+			body.Close()
+			body = nil
+		}
 		log.Debugf("no good data from %d", i)
 	}
 	err = fmt.Errorf("invalid response")
+	if timedOut {
+		err = errHostTimeout
+	}
+	return
+}
+
+// forward passes a visitor's request on to a host that proxies a
+// local server and writes back the response exactly as it was sent
+func (s *server) forward(w http.ResponseWriter, r *http.Request, domain, prefix, ipAddress string) (err error) {
+	// the local server gets the path as the visitor escaped it
+	urlPath := strings.TrimPrefix(r.URL.EscapedPath(), (&url.URL{Path: prefix}).EscapedPath())
+	if urlPath == "" {
+		urlPath = "/"
+	}
+
+	req, err := newRequest(r, ipAddress)
+	if err == errBodyTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return nil
+	} else if err != nil {
+		return
+	}
+
+	p, body, err := s.get(r.Context(), domain, urlPath, req)
+	if err != nil {
+		log.Debugf("problem forwarding %s%s: %s", domain, urlPath, err.Error())
+		if err == errHostTimeout {
+			http.Error(w, "gateway timeout", http.StatusGatewayTimeout)
+			return nil
+		}
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return nil
+	}
+	defer body.Close()
+
+	writeHeader(w, prefix, p)
+	w.WriteHeader(p.Status)
+	_, err = copyFlush(w, body)
+	if err != nil {
+		log.Debugf("problem streaming %s%s: %s", domain, urlPath, err.Error())
+		err = nil
+	}
 	return
 }
 
+// isproxy returns whether the hosts of a domain proxy a local server
+func (s *server) isproxy(domain string) bool {
+	connections := s.connections(domain)
+	return len(connections) > 0 && connections[0].Proxy
+}
+
+// copyFlush copies a response body to the requester, flushing
+// after each write so the requester sees data as it arrives
+func copyFlush(w http.ResponseWriter, r io.Reader) (written int64, err error) {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, errRead := r.Read(buf)
+		if n > 0 {
+			var nw int
+			nw, err = w.Write(buf[:n])
+			written += int64(nw)
+			if err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if errRead == io.EOF {
+			return
+		} else if errRead != nil {
+			err = errRead
+			return
+		}
+	}
+}
+
 func (s *server) dumpConnection(domain string, id int) (err error) {
 	s.Lock()
 	defer s.Unlock()
@@ -452,7 +1054,19 @@ func (s *server) dumpConnection(domain string, id int) (err error) {
 	for i, conn := range s.conn[domain] {
 		if conn.ID == id {
 			log.Debugf("dumping connection %s/%d", domain, id)
+			conn.ws.Close()
 			s.conn[domain] = remove(s.conn[domain], i)
+			if len(s.conn[domain]) == 0 {
+				// hold the domain so its owner can reconnect
+				delete(s.conn, domain)
+				if s.cache != nil {
+					s.cache.clear(domain)
+				}
+				s.reserved[domain] = reservation{
+					Key:     conn.Key,
+					Expires: time.Now().Add(gracePeriod),
+				}
+			}
 			return
 		}
 	}
@@ -461,5 +1075,7 @@ func (s *server) dumpConnection(domain string, id int) (err error) {
 }
 
 func remove(slice []*connection, s int) []*connection {
-	return append(slice[:s], slice[s+1:]...)
+	removed := make([]*connection, 0, len(slice)-1)
+	removed = append(removed, slice[:s]...)
+	return append(removed, slice[s+1:]...)
 }
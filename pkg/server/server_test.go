@@ -0,0 +1,387 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/schollz/hostyoself/pkg/wsconn"
+	"github.com/vincent-petithory/dataurl"
+)
+
+// echoFiles are the files echoHost lists, which are all in files/.
+// Each has its path as its content.
+var echoFiles = []File{
+	{FullPath: "files/b.txt", Size: 300, Modified: 1000},
+	{FullPath: "files/A.txt", Size: 200, Modified: 3000},
+	{FullPath: "files/c.txt", Size: 100, Modified: 2000},
+	{FullPath: "files/docs/guide.md", Size: 50, Modified: 4000},
+	{FullPath: "files/docs/notes.md", Size: 60, Modified: 5000},
+	{FullPath: "files/secret.zip", Size: 1000, Modified: 6000},
+}
+
+// echoHost returns a connection for a domain whose host answers every
+// request with what it was sent as headers, and an empty body. It
+// lists echoFiles, and nothing else is in files/.
+func echoHost(t *testing.T, domain, key string) *connection {
+	listing, err := json.Marshal(echoFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := hostConnection(t, domain, key, func(ws *wsconn.WebsocketConn) {
+		for {
+			p, err := ws.Receive()
+			if err != nil {
+				return
+			}
+			if p.Type == "files" {
+				ws.Send(wsconn.Payload{
+					ID:      p.ID,
+					Type:    p.Type,
+					Success: true,
+					Message: string(listing),
+					Key:     key,
+				})
+				continue
+			}
+			header := http.Header{"X-Path": []string{p.Message}}
+			for k, vv := range p.Header {
+				header["X-Request-"+k] = vv
+			}
+			resp := wsconn.Payload{
+				ID:      p.ID,
+				Type:    p.Type,
+				Success: true,
+				Status:  http.StatusOK,
+				Header:  header,
+				Key:     key,
+			}
+			if strings.HasPrefix(p.Message+"/", "files/") {
+				resp.Success = false
+				resp.Status = http.StatusNotFound
+				resp.Message = "no such file"
+				for _, f := range echoFiles {
+					if f.FullPath == p.Message {
+						resp.Success = true
+						resp.Status = http.StatusOK
+						resp.Message = dataurl.EncodeBytes([]byte(f.FullPath))
+						resp.Size = int64(len(f.FullPath))
+						resp.Modified = f.Modified
+					}
+				}
+			}
+			ws.Send(resp)
+		}
+	})
+	go conn.listen()
+	return conn
+}
+
+func TestForwardPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/px/a/b", want: "/a/b"},
+		{path: "/px/a%3Fb", want: "/a%3Fb"},
+		{path: "/px/a%23b", want: "/a%23b"},
+		{path: "/px/a%2Fb", want: "/a%2Fb"},
+		{path: "/px/", want: "/"},
+	}
+	s := New("http://relay.test", "8001")
+	conn := echoHost(t, "px", "key")
+	conn.Proxy = true
+	s.conn["px"] = []*connection{conn}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.handler(w, httptest.NewRequest("GET", tt.path, nil))
+			if got := w.Header().Get("X-Path"); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		header http.Header
+		want   http.Header
+	}{
+		{
+			name:   "cookie in path mode",
+			prefix: "/site",
+			header: http.Header{"Set-Cookie": {"session=1; Path=/; Domain=relay.test; HttpOnly"}},
+			want:   http.Header{"Set-Cookie": {"session=1; Path=/site/; HttpOnly"}},
+		},
+		{
+			name:   "cookie without a path",
+			prefix: "/site",
+			header: http.Header{"Set-Cookie": {"session=1"}},
+			want:   http.Header{"Set-Cookie": {"session=1; Path=/site/"}},
+		},
+		{
+			name:   "cookie with a path",
+			prefix: "/site",
+			header: http.Header{"set-cookie": {"session=1; Path=/app"}},
+			want:   http.Header{"Set-Cookie": {"session=1; Path=/site/app"}},
+		},
+		{
+			name:   "cookie on a subdomain",
+			header: http.Header{"Set-Cookie": {"session=1; Path=/; Domain=relay.test"}},
+			want:   http.Header{"Set-Cookie": {"session=1; Path=/"}},
+		},
+		{
+			name:   "bad cookie",
+			prefix: "/site",
+			header: http.Header{"Set-Cookie": {"=1"}},
+			want:   http.Header{},
+		},
+		{
+			name:   "origin headers in path mode",
+			prefix: "/site",
+			header: http.Header{
+				"Clear-Site-Data":           {`"*"`},
+				"strict-transport-security": {"max-age=31536000"},
+				"Service-Worker-Allowed":    {"/"},
+				"X-Frame-Options":           {"DENY"},
+			},
+			want: http.Header{"X-Frame-Options": {"DENY"}},
+		},
+		{
+			name: "origin headers on a subdomain",
+			header: http.Header{
+				"Clear-Site-Data":           {`"*"`},
+				"Strict-Transport-Security": {"max-age=31536000"},
+			},
+			want: http.Header{
+				"Clear-Site-Data":           {`"*"`},
+				"Strict-Transport-Security": {"max-age=31536000"},
+			},
+		},
+		{
+			name:   "redirect",
+			prefix: "/site",
+			header: http.Header{"Location": {"/other/"}},
+			want:   http.Header{"Location": {"/site/other/"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeHeader(w, tt.prefix, wsconn.Payload{Header: tt.header})
+			if !reflect.DeepEqual(w.Header(), tt.want) {
+				t.Errorf("got %v, want %v", w.Header(), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		want   *wsconn.Range
+	}{
+		{header: "bytes=0-4", want: &wsconn.Range{Start: 0, End: 4}},
+		{header: "bytes=5-", want: &wsconn.Range{Start: 5, End: -1}},
+		{header: "bytes=-3", want: &wsconn.Range{Start: -3, End: -1}},
+		{header: "bytes=2-100", want: &wsconn.Range{Start: 2, End: 100}},
+		{header: "bytes=100-", want: &wsconn.Range{Start: 100, End: -1}},
+		{header: ""},
+		{header: "bytes=-0"},
+		{header: "bytes=-"},
+		{header: "bytes=4-2"},
+		{header: "bytes=-3-5"},
+		{header: "bytes=a-b"},
+		{header: "bytes=0-1,4-5"},
+		{header: "items=0-4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := parseRange(tt.header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRange(t *testing.T) {
+	const content = "0123456789"
+	const etag = `"v2"`
+	// the host answers ranges the way the client does
+	conn := hostConnection(t, "site", "key", func(ws *wsconn.WebsocketConn) {
+		for {
+			p, err := ws.Receive()
+			if err != nil {
+				return
+			}
+			resp := wsconn.Payload{
+				ID:      p.ID,
+				Type:    "get",
+				Success: true,
+				Status:  http.StatusOK,
+				Header:  http.Header{"Accept-Ranges": []string{"bytes"}},
+				ETag:    etag,
+				Key:     "key",
+			}
+			body := content
+			if p.Range != nil && (p.Range.IfRange == "" || p.Range.IfRange == etag) {
+				start, end, ok := p.Range.Resolve(int64(len(content)))
+				if !ok {
+					resp.Success = false
+					resp.Status = http.StatusRequestedRangeNotSatisfiable
+					resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", len(content)))
+					resp.Message = "range not satisfiable"
+					ws.Send(resp)
+					continue
+				}
+				resp.Status = http.StatusPartialContent
+				resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+				body = content[start : end+1]
+			}
+			resp.Size = int64(len(body))
+			resp.Message = dataurl.EncodeBytes([]byte(body))
+			ws.Send(resp)
+		}
+	})
+	go conn.listen()
+	s := New("http://relay.test", "8001")
+	s.conn["site"] = []*connection{conn}
+
+	tests := []struct {
+		name    string
+		rng     string
+		ifRange string
+		status  int
+		// contentRange is the Content-Range header wanted, if any
+		contentRange string
+		body         string
+	}{
+		{name: "whole file", status: http.StatusOK, body: content},
+		{name: "closed", rng: "bytes=2-4", status: http.StatusPartialContent, contentRange: "bytes 2-4/10", body: "234"},
+		{name: "open-ended", rng: "bytes=7-", status: http.StatusPartialContent, contentRange: "bytes 7-9/10", body: "789"},
+		{name: "suffix", rng: "bytes=-4", status: http.StatusPartialContent, contentRange: "bytes 6-9/10", body: "6789"},
+		{name: "suffix longer than the file", rng: "bytes=-40", status: http.StatusPartialContent, contentRange: "bytes 0-9/10", body: content},
+		{name: "end past size", rng: "bytes=8-20", status: http.StatusPartialContent, contentRange: "bytes 8-9/10", body: "89"},
+		{name: "unsatisfiable", rng: "bytes=10-", status: http.StatusRequestedRangeNotSatisfiable, contentRange: "bytes */10"},
+		{name: "several ranges", rng: "bytes=0-1,4-5", status: http.StatusOK, body: content},
+		{name: "current If-Range", rng: "bytes=2-4", ifRange: etag, status: http.StatusPartialContent, contentRange: "bytes 2-4/10", body: "234"},
+		{name: "stale If-Range", rng: "bytes=2-4", ifRange: `"v1"`, status: http.StatusOK, body: content},
+		{name: "stale If-Range on an unsatisfiable range", rng: "bytes=10-", ifRange: `"v1"`, status: http.StatusOK, body: content},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/site/file.txt", nil)
+			if tt.rng != "" {
+				r.Header.Set("Range", tt.rng)
+			}
+			if tt.ifRange != "" {
+				r.Header.Set("If-Range", tt.ifRange)
+			}
+			w := httptest.NewRecorder()
+			s.handler(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("got %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("got Content-Range %q, want %q", got, tt.contentRange)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("got %q, want %q", w.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+func TestDomainOwner(t *testing.T) {
+	s := New("http://relay.test", "8001")
+	ts := httptest.NewServer(http.HandlerFunc(s.handler))
+	t.Cleanup(ts.Close)
+	// join connects to the relay as a host with a key, returning
+	// what the relay answered and the websocket if it was let in
+	join := func(key string) (wsconn.Payload, *websocket.Conn) {
+		c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws := wsconn.New(c)
+		err = ws.Send(wsconn.Payload{Type: "domain", Message: "site", Key: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := ws.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.Success {
+			c.Close()
+			return p, nil
+		}
+		return p, c
+	}
+	// leave closes a websocket and waits for the relay to notice
+	leave := func(c *websocket.Conn) {
+		c.Close()
+		for deadline := time.Now().Add(time.Second); s.isdomain("site"); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("relay kept the connection")
+			}
+		}
+	}
+	refused := "domain 'site' is already in use by another key"
+
+	owner := testConnection(t, "site", "key")
+	owner.ID = 1
+	s.conn["site"] = []*connection{owner}
+
+	// another key can't join while the owner is connected
+	p, _ := join("otherkey")
+	if p.Success || p.Type != "domain" || p.Message != refused {
+		t.Errorf("joined with another key: %+v", p)
+	}
+
+	// or while the domain is held for the owner
+	if err := s.dumpConnection("site", owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	p, _ = join("otherkey")
+	if p.Success || p.Message != refused {
+		t.Errorf("joined with another key within the grace period: %+v", p)
+	}
+
+	// the owner can come back in the meantime
+	p, c := join("key")
+	if !p.Success {
+		t.Fatalf("owner could not reclaim the domain: %+v", p)
+	}
+	leave(c)
+
+	// and once the reservation expires anyone can take the domain
+	s.Lock()
+	r := s.reserved["site"]
+	if r.Key != "key" {
+		t.Errorf("domain is reserved for %q, want %q", r.Key, "key")
+	}
+	r.Expires = time.Now().Add(-time.Second)
+	s.reserved["site"] = r
+	s.Unlock()
+	p, c = join("otherkey")
+	if !p.Success {
+		t.Fatalf("could not take the domain after the reservation expired: %+v", p)
+	}
+	leave(c)
+	s.Lock()
+	r = s.reserved["site"]
+	s.Unlock()
+	if r.Key != "otherkey" {
+		t.Errorf("domain is reserved for %q, want %q", r.Key, "otherkey")
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/schollz/logger"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACME configures getting certificates automatically from an ACME
+// server such as Let's Encrypt
+type ACME struct {
+	// Email is given to the ACME server as a contact
+	Email string
+	// CacheDir keeps the certificates between restarts
+	CacheDir string
+	// DirectoryURL is the ACME server, Let's Encrypt if empty
+	DirectoryURL string
+	// RootCA is a PEM file of certificates to trust for the ACME
+	// server, for testing against servers like pebble
+	RootCA string
+	// HTTPPort answers http-01 challenges and redirects everything
+	// else to HTTPS, if set
+	HTTPPort string
+}
+
+// tlsConfig returns the TLS configuration that gets certificates
+// from the ACME server for the relay's public host
+func (s *server) tlsConfig() (config *tls.Config, err error) {
+	u, err := url.Parse(s.publicURL)
+	if err != nil {
+		return
+	}
+	host := u.Hostname()
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Email:      s.ACME.Email,
+		HostPolicy: s.hostPolicy(host),
+	}
+	if s.ACME.CacheDir != "" {
+		m.Cache = autocert.DirCache(s.ACME.CacheDir)
+	}
+	if s.ACME.DirectoryURL != "" || s.ACME.RootCA != "" {
+		m.Client = &acme.Client{DirectoryURL: s.ACME.DirectoryURL}
+		if s.ACME.RootCA != "" {
+			var b []byte
+			b, err = ioutil.ReadFile(s.ACME.RootCA)
+			if err != nil {
+				return
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(b) {
+				err = fmt.Errorf("no certificates found in %s", s.ACME.RootCA)
+				return
+			}
+			m.Client.HTTPClient = &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{RootCAs: pool},
+				},
+			}
+		}
+	}
+
+	if s.ACME.HTTPPort != "" {
+		go func() {
+			log.Infof("answering ACME challenges on :%s", s.ACME.HTTPPort)
+			errHTTP := http.ListenAndServe(":"+s.ACME.HTTPPort, m.HTTPHandler(http.HandlerFunc(s.redirectHTTP)))
+			if errHTTP != nil {
+				log.Error(errHTTP)
+			}
+		}()
+	}
+
+	config = m.TLSConfig()
+	return
+}
+
+// redirectHTTP sends visitors on plain HTTP to HTTPS, except for the
+// challenge files of custom hostnames which can't be fetched over
+// HTTPS until they have a certificate
+func (s *server) redirectHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, challengePath) {
+		s.handler(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "use HTTPS", http.StatusBadRequest)
+		return
+	}
+	host := cleanHostname(r.Host)
+	if s.port != "443" {
+		host = net.JoinHostPort(host, s.port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusFound)
+}
+
+// subdomainCerts is how many certificates for subdomains the relay
+// asks for in certWindow. Anyone can host a domain, so without a limit
+// hosts could use up the 50 certificates a week Let's Encrypt gives
+// the relay's registered domain, and the relay couldn't get its own.
+const subdomainCerts = 40
+
+// certWindow is how long a certificate asked for counts against
+// subdomainCerts
+const certWindow = 7 * 24 * time.Hour
+
+// hostPolicy only allows certificates for the relay's public host,
+// the subdomains of domains that are hosted or reserved if domains
+// are served on them, up to subdomainCerts of them in certWindow,
+// and verified hostnames
+func (s *server) hostPolicy(host string) autocert.HostPolicy {
+	return func(_ context.Context, name string) error {
+		name = strings.ToLower(name)
+		if name == strings.ToLower(host) {
+			return nil
+		}
+		s.Lock()
+		defer s.Unlock()
+		if domain := strings.TrimSuffix(name, "."+strings.ToLower(host)); s.Subdomains && domain != name {
+			r, reserved := s.reserved[domain]
+			if len(s.conn[domain]) > 0 || (reserved && time.Now().Before(r.Expires)) {
+				return s.countCert(name)
+			}
+		}
+		if h, ok := s.hostnames[name]; ok && h.Verified {
+			return nil
+		}
+		return fmt.Errorf("acme/autocert: host %q not configured", name)
+	}
+}
+
+// countCert counts a certificate asked for a subdomain against
+// subdomainCerts, where asking again for the same one is free
+func (s *server) countCert(name string) error {
+	now := time.Now()
+	for n, asked := range s.certs {
+		if now.Sub(asked) > certWindow {
+			delete(s.certs, n)
+		}
+	}
+	if _, ok := s.certs[name]; ok {
+		return nil
+	}
+	if len(s.certs) >= subdomainCerts {
+		log.Infof("not getting a certificate for %s, %d were asked for this week", name, len(s.certs))
+		return fmt.Errorf("acme/autocert: too many certificates for subdomains, %s has to wait", name)
+	}
+	s.certs[name] = now
+	return nil
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// acmeServer is an RFC 8555 directory that signs whatever it is asked
+// to, standing in for pebble
+type acmeServer struct {
+	*httptest.Server
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	sync.Mutex
+	nonce int
+	cert  []byte
+}
+
+func newACMEServer(t *testing.T) *acmeServer {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &acmeServer{caKey: caKey, caCert: caCert}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dir", a.directory)
+	mux.HandleFunc("/nonce", a.replay(nil))
+	mux.HandleFunc("/account", a.replay(a.account))
+	mux.HandleFunc("/order", a.replay(a.order))
+	mux.HandleFunc("/order/1", a.replay(a.order))
+	mux.HandleFunc("/finalize", a.replay(a.finalize))
+	mux.HandleFunc("/cert", a.replay(a.certificate))
+	a.Server = httptest.NewTLSServer(mux)
+	t.Cleanup(a.Close)
+	return a
+}
+
+func (a *acmeServer) directory(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"newNonce":   a.URL + "/nonce",
+		"newAccount": a.URL + "/account",
+		"newOrder":   a.URL + "/order",
+	})
+}
+
+// replay gives every response a new nonce and hands the payload of
+// the JWS that was posted to the handler
+func (a *acmeServer) replay(handler func(w http.ResponseWriter, payload []byte)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.Lock()
+		a.nonce++
+		w.Header().Set("Replay-Nonce", strconv.Itoa(a.nonce))
+		a.Unlock()
+		if handler == nil {
+			return
+		}
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&jws)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		handler(w, payload)
+	}
+}
+
+func (a *acmeServer) account(w http.ResponseWriter, _ []byte) {
+	w.Header().Set("Location", a.URL+"/account/1")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+}
+
+// order is always ready, as if the relay had answered its challenges
+func (a *acmeServer) order(w http.ResponseWriter, payload []byte) {
+	a.Lock()
+	status := "ready"
+	if a.cert != nil {
+		status = "valid"
+	}
+	a.Unlock()
+	w.Header().Set("Location", a.URL+"/order/1")
+	if len(payload) > 0 {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         status,
+		"authorizations": []string{},
+		"finalize":       a.URL + "/finalize",
+		"certificate":    a.URL + "/cert",
+	})
+}
+
+func (a *acmeServer) finalize(w http.ResponseWriter, payload []byte) {
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	json.Unmarshal(payload, &req)
+	b, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// like real CAs, the common name is a name of the certificate too
+	names := csr.DNSNames
+	if csr.Subject.CommonName != "" {
+		names = append([]string{csr.Subject.CommonName}, names...)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, a.caCert, csr.PublicKey, a.caKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.Lock()
+	a.cert = der
+	a.Unlock()
+	a.order(w, nil)
+}
+
+func (a *acmeServer) certificate(w http.ResponseWriter, _ []byte) {
+	a.Lock()
+	defer a.Unlock()
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: a.cert})
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: a.caCert.Raw})
+}
+
+func TestACME(t *testing.T) {
+	a := newACMEServer(t)
+	// the directory is trusted through the root given to the relay
+	rootCA := filepath.Join(t.TempDir(), "root.pem")
+	err := ioutil.WriteFile(rootCA, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.Certificate().Raw}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New("https://relay.test", "8001")
+	s.ACME = &ACME{
+		CacheDir:     t.TempDir(),
+		DirectoryURL: a.URL + "/dir",
+		RootCA:       rootCA,
+	}
+	config, err := s.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello := &tls.ClientHelloInfo{
+		ServerName:   "relay.test",
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
+	cert, err := config.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname("relay.test"); err != nil {
+		t.Error(err)
+	}
+
+	// hostnames that aren't the relay's are refused
+	hello.ServerName = "other.test"
+	if _, err := config.GetCertificate(hello); err == nil {
+		t.Error("got a certificate for a hostname that isn't the relay's")
+	}
+}
+
+func TestHostPolicy(t *testing.T) {
+	s := New("https://relay.test", "443")
+	s.Subdomains = true
+	for i := 0; i < subdomainCerts+1; i++ {
+		s.conn[fmt.Sprintf("site%d", i)] = []*connection{{}}
+	}
+	s.reserved["gone"] = reservation{Expires: time.Now().Add(time.Minute)}
+	s.reserved["expired"] = reservation{Expires: time.Now().Add(-time.Minute)}
+	s.hostnames["www.example.com"] = hostname{Domain: "site0", Verified: true}
+	s.hostnames["unverified.example.com"] = hostname{Domain: "site0"}
+	// one subdomain was asked for long enough ago not to count
+	s.certs["old.relay.test"] = time.Now().Add(-certWindow - time.Hour)
+	policy := s.hostPolicy("relay.test")
+
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{name: "relay.test", ok: true},
+		{name: "RELAY.test", ok: true},
+		{name: "site0.relay.test", ok: true},
+		{name: "gone.relay.test", ok: true},
+		{name: "expired.relay.test"},
+		{name: "nobody.relay.test"},
+		{name: "site1.other.test"},
+		{name: "www.example.com", ok: true},
+		{name: "unverified.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := policy(context.Background(), tt.name); (err == nil) != tt.ok {
+				t.Errorf("got %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+
+	// subdomains stop getting certificates once there are enough
+	// of them this week
+	for i := 1; i < subdomainCerts-1; i++ {
+		if err := policy(context.Background(), fmt.Sprintf("site%d.relay.test", i)); err != nil {
+			t.Fatalf("site%d: %s", i, err)
+		}
+	}
+	if err := policy(context.Background(), fmt.Sprintf("site%d.relay.test", subdomainCerts)); err == nil {
+		t.Error("got a certificate past the limit")
+	}
+	// but asking again for one it got is fine, and so are the
+	// relay and verified hostnames
+	for _, name := range []string{"site0.relay.test", "relay.test", "www.example.com"} {
+		if err := policy(context.Background(), name); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+
+	"github.com/schollz/hostyoself/pkg/wsconn"
+	log "github.com/schollz/logger"
+)
+
+// acceptsUploads returns whether the hosts of a domain save files
+// uploaded by visitors
+func (s *server) acceptsUploads(domain string) bool {
+	connections := s.connections(domain)
+	return len(connections) > 0 && connections[0].Upload
+}
+
+// upload streams each file of a multipart POST to a host of the domain
+// as it arrives, without keeping it on the relay
+func (s *server) upload(w http.ResponseWriter, r *http.Request, domain, prefix, urlPath, ipAddress string) (err error) {
+	connections := s.connections(domain)
+	if len(connections) == 0 {
+		http.Error(w, "no hosts", http.StatusBadGateway)
+		return nil
+	}
+	conn := connections[rand.Intn(len(connections))]
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	saved := []string{}
+	for {
+		part, errPart := mr.NextPart()
+		if errPart == io.EOF {
+			break
+		} else if errPart != nil {
+			http.Error(w, errPart.Error(), http.StatusBadRequest)
+			return nil
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		resp, errUpload := conn.upload(r.Context(), wsconn.Payload{
+			Type:        "upload",
+			Message:     part.FileName(),
+			ContentType: part.Header.Get("Content-Type"),
+			IPAddress:   ipAddress,
+		}, part)
+		part.Close()
+		if errUpload == errHostTimeout {
+			log.Debugf("problem uploading to %s: %s", domain, errUpload.Error())
+			s.dumpConnection(domain, conn.ID)
+			http.Error(w, "gateway timeout", http.StatusGatewayTimeout)
+			return nil
+		} else if errUpload != nil {
+			log.Debugf("problem uploading to %s: %s", domain, errUpload.Error())
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return nil
+		}
+		if resp.Key != conn.Key {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return nil
+		}
+		if !resp.Success {
+			status := resp.Status
+			if status == 0 {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, resp.Message, status)
+			return nil
+		}
+		log.Infof("%s uploaded %s to %s", ipAddress, resp.Message, domain)
+		saved = append(saved, resp.Message)
+	}
+	if len(saved) == 0 {
+		http.Error(w, "no files", http.StatusBadRequest)
+		return nil
+	}
+
+	// forms go back to the page they were sent from
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, prefix+urlPath, http.StatusSeeOther)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(saved)
+}
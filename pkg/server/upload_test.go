@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/schollz/hostyoself/pkg/wsconn"
+	"github.com/vincent-petithory/dataurl"
+)
+
+// uploadHost saves what it is sent in files, refusing big.bin as too
+// large and answering other.bin with the wrong key
+func uploadHost(t *testing.T, files map[string]string) *connection {
+	conn := hostConnection(t, "site", "key", func(ws *wsconn.WebsocketConn) {
+		names := make(map[int64]string)
+		for {
+			p, err := ws.Receive()
+			if err != nil {
+				return
+			}
+			if p.Type == "upload" {
+				names[p.ID] = p.Message
+				continue
+			}
+			data := p.Data
+			if data == nil && p.Message != "" {
+				dataURL, errDecode := dataurl.DecodeString(p.Message)
+				if errDecode != nil {
+					return
+				}
+				data = dataURL.Data
+			}
+			name := names[p.ID]
+			files[name] += string(data)
+			if !p.Done {
+				continue
+			}
+			resp := wsconn.Payload{ID: p.ID, Type: "upload", Success: true, Status: http.StatusCreated, Message: "uploads/" + name, Key: "key"}
+			switch name {
+			case "big.bin":
+				resp = wsconn.Payload{ID: p.ID, Type: "upload", Status: http.StatusRequestEntityTooLarge, Message: "too large", Key: "key"}
+			case "other.bin":
+				resp.Key = "other"
+			}
+			ws.Send(resp)
+		}
+	})
+	conn.Upload = true
+	go conn.listen()
+	return conn
+}
+
+func TestUpload(t *testing.T) {
+	large := string(bytes.Repeat([]byte("x"), 3*uploadChunkSize+1))
+	tests := []struct {
+		name string
+		// files are uploaded by name, fields are other form values
+		files  map[string]string
+		fields map[string]string
+		accept string
+		want   int
+		// saved is what the host should get
+		saved map[string]string
+		// wantNames is the JSON answer, for uploads that work
+		wantNames []string
+	}{
+		{
+			name:      "one file",
+			files:     map[string]string{"notes.txt": "hello"},
+			want:      http.StatusOK,
+			saved:     map[string]string{"notes.txt": "hello"},
+			wantNames: []string{"uploads/notes.txt"},
+		},
+		{
+			name:      "in chunks",
+			files:     map[string]string{"large.bin": large},
+			want:      http.StatusOK,
+			saved:     map[string]string{"large.bin": large},
+			wantNames: []string{"uploads/large.bin"},
+		},
+		{
+			name:      "fields are skipped",
+			files:     map[string]string{"notes.txt": "hello"},
+			fields:    map[string]string{"comment": "hi"},
+			want:      http.StatusOK,
+			saved:     map[string]string{"notes.txt": "hello"},
+			wantNames: []string{"uploads/notes.txt"},
+		},
+		{
+			name:   "from a form",
+			files:  map[string]string{"notes.txt": "hello"},
+			accept: "text/html",
+			want:   http.StatusSeeOther,
+			saved:  map[string]string{"notes.txt": "hello"},
+		},
+		{
+			name:  "refused by the host",
+			files: map[string]string{"big.bin": "xx"},
+			want:  http.StatusRequestEntityTooLarge,
+			saved: map[string]string{"big.bin": "xx"},
+		},
+		{
+			name:  "answered with another key",
+			files: map[string]string{"other.bin": "xx"},
+			want:  http.StatusBadGateway,
+			saved: map[string]string{"other.bin": "xx"},
+		},
+		{
+			name:   "no files",
+			fields: map[string]string{"comment": "hi"},
+			want:   http.StatusBadRequest,
+			saved:  map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := make(map[string]string)
+			s := New("http://relay.test", "8001")
+			s.conn["site"] = []*connection{uploadHost(t, saved)}
+
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			for k, v := range tt.fields {
+				mw.WriteField(k, v)
+			}
+			for name, data := range tt.files {
+				fw, err := mw.CreateFormFile("file", name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				fw.Write([]byte(data))
+			}
+			mw.Close()
+			r := httptest.NewRequest("POST", "/site/", &body)
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			s.handler(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("got %d (%s), want %d", w.Code, w.Body.String(), tt.want)
+			}
+			if !reflect.DeepEqual(saved, tt.saved) {
+				t.Errorf("host got %d files, want %d", len(saved), len(tt.saved))
+			}
+			if tt.wantNames != nil {
+				var names []string
+				if err := json.Unmarshal(w.Body.Bytes(), &names); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(names, tt.wantNames) {
+					t.Errorf("got %v, want %v", names, tt.wantNames)
+				}
+			}
+		})
+	}
+}
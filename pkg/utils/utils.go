@@ -1,12 +1,18 @@
 package utils
 
 import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 )
 
 // GetClientIPHelper gets the client IP using a mixture of techniques.
@@ -90,6 +96,106 @@ func getClientIPByHeaders(req *http.Request) (ip string, err error) {
 
 }
 
+// hopHeaders are the headers that only apply to a single connection
+// and must not be passed on by proxies
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopHeaders returns a copy of the headers without
+// the hop-by-hop headers
+func RemoveHopHeaders(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, vv := range h {
+		h2[k] = append([]string(nil), vv...)
+	}
+	for _, f := range h["Connection"] {
+		for _, k := range strings.Split(f, ",") {
+			h2.Del(strings.TrimSpace(k))
+		}
+	}
+	for _, k := range hopHeaders {
+		h2.Del(k)
+	}
+	return h2
+}
+
+// NotModified returns whether a GET or HEAD request's If-None-Match or
+// If-Modified-Since headers show the visitor already has this version
+func NotModified(h http.Header, etag string, modified time.Time) bool {
+	if inm := h.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := h.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		return !modified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// VerificationToken is what the owner of a domain publishes to prove a
+// custom hostname is theirs, either in a TXT record or a challenge file
+func VerificationToken(domain, key, hostname string) string {
+	h := sha256.Sum256([]byte(domain + "\n" + key + "\n" + strings.ToLower(hostname)))
+	return hex.EncodeToString(h[:16])
+}
+
+// PasswordHash is how a password is sent to and kept by the relay
+func PasswordHash(password string) string {
+	h := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(h[:])
+}
+
+// NewSecret returns a random secret for SiteToken and SignLink. It is
+// never the key of a domain, which would give the key away to anyone
+// trying every key against a token they were given.
+func NewSecret() (secret string, err error) {
+	b := make([]byte, 32)
+	_, err = crand.Read(b)
+	if err != nil {
+		return
+	}
+	secret = hex.EncodeToString(b)
+	return
+}
+
+// SiteToken signs a domain with the secret of its hosts, which lets
+// visitors into a password protected site without the password
+func SiteToken(domain, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(domain))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// SignLink signs a link to a file of a domain that works until expires
+// (in Unix seconds, never if zero) for a number of downloads (any if zero),
+// with the secret of its hosts
+func SignLink(domain, secret, path string, expires int64, downloads int) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%d", domain, path, expires, downloads)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
 const letterBytes = "abcdefghijklmnopqrstuvwxyz"
 const (
 	letterIdxBits = 6                    // 6 bits to represent a letter index
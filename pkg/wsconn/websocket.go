@@ -1,7 +1,10 @@
 package wsconn
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"net/http"
 	"sync"
 
 	"github.com/gorilla/websocket"
@@ -10,11 +13,115 @@ import (
 
 // Payload lists the data exchanged
 type Payload struct {
+	// ID identifies a request so that its response can be routed
+	// back to the one waiting for it
+	ID        int64  `json:"id,omitempty"`
 	Success   bool   `json:"success"`
 	Type      string `json:"type,omitempty"`
 	Message   string `json:"message,omitempty"`
 	IPAddress string `json:"ip,omitempty"`
 	Key       string `json:"key,omitempty"`
+
+	// Chunked marks a response whose body follows in "chunk"
+	// payloads, numbered from zero by Chunk, the last one being Done
+	Chunked     bool   `json:"chunked,omitempty"`
+	Chunk       int    `json:"chunk,omitempty"`
+	Done        bool   `json:"done,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+
+	// Method, Query, Header and Body describe the visitor's request,
+	// and Status and Header the host's response to it
+	Method string      `json:"method,omitempty"`
+	Query  string      `json:"query,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+	Status int         `json:"status,omitempty"`
+	// Range asks for only part of a file
+	Range *Range `json:"range,omitempty"`
+	// ETag and Modified (in Unix seconds) identify the version
+	// of a file sent by a host
+	ETag     string `json:"etag,omitempty"`
+	Modified int64  `json:"modified,omitempty"`
+
+	// URL is where the relay serves the domain, sent back
+	// during the "domain" handshake
+	URL string `json:"url,omitempty"`
+	// Hostname is a custom hostname claimed during the "domain"
+	// handshake, and the hostname a "hostname" update is about
+	Hostname string `json:"hostname,omitempty"`
+
+	// Proxy is set during the "domain" handshake by hosts that
+	// forward requests to a local HTTP server rather than a folder
+	Proxy bool `json:"proxy,omitempty"`
+
+	// Credentials are hashed passwords by user sent during the
+	// "domain" handshake by hosts that only let in visitors with them
+	Credentials map[string]string `json:"credentials,omitempty"`
+	// Secret is sent during the "domain" handshake by hosts that sign
+	// tokens, for the relay to check them with
+	Secret string `json:"secret,omitempty"`
+	// Links are paths that hosts only share through signed links
+	Links []string `json:"links,omitempty"`
+
+	// Upload is set during the "domain" handshake by hosts that
+	// save files uploaded by visitors
+	Upload bool `json:"upload,omitempty"`
+
+	// Binary is set during the "domain" handshake by hosts that
+	// send chunks as binary frames, and echoed by relays that accept them
+	Binary bool `json:"binary,omitempty"`
+	// Data holds the raw bytes of a chunk received as a binary frame
+	Data []byte `json:"-"`
+
+	// Credit is set during the "domain" handshake by hosts that wait
+	// for "credit" payloads, each granting Chunk more chunks of the
+	// response with its ID, and echoed by relays that send them
+	Credit bool `json:"credit,omitempty"`
+}
+
+// Window is how many chunks of a response a host sends ahead of the
+// relay before it has to wait for credit
+const Window = 16
+
+// binary frames carry a chunk as a header followed by the raw bytes:
+// the request ID (8 bytes), the chunk number (4 bytes) and flags (1 byte)
+const binaryHeaderSize = 13
+
+const (
+	flagSuccess = 1 << iota
+	flagDone
+)
+
+// Range is a single byte range of a file, as asked for by a visitor.
+// A negative Start asks for the last -Start bytes, and an End of -1
+// asks for everything through the end of the file.
+type Range struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// IfRange is the visitor's If-Range header, if any. The range
+	// only applies if it still matches the file.
+	IfRange string `json:"ifRange,omitempty"`
+}
+
+// Resolve returns the first and last byte of the range in a file
+// of the given size, and whether the range can be satisfied at all
+func (r Range) Resolve(size int64) (start, end int64, ok bool) {
+	if r.Start < 0 {
+		start = size + r.Start
+		if start < 0 {
+			start = 0
+		}
+		end = size - 1
+	} else {
+		start = r.Start
+		end = r.End
+		if end < 0 || end >= size {
+			end = size - 1
+		}
+	}
+	ok = start < size && start <= end
+	return
 }
 
 func (p Payload) String() string {
@@ -23,11 +130,12 @@ func (p Payload) String() string {
 }
 
 // WebsocketConn provides convenience functions for sending
-// and receiving data with websockets, using mutex to
-// make sure only one writer/reader
+// and receiving data with websockets, using mutexes to
+// make sure only one writer and one reader at a time
 type WebsocketConn struct {
-	ws *websocket.Conn
-	sync.Mutex
+	ws         *websocket.Conn
+	writeMutex sync.Mutex
+	readMutex  sync.Mutex
 }
 
 // NewWebsocket returns a new websocket
@@ -38,25 +146,66 @@ func New(ws *websocket.Conn) *WebsocketConn {
 }
 
 func (ws *WebsocketConn) Close() (err error) {
-	ws.Lock()
-	defer ws.Unlock()
-	ws.Close()
-	ws = nil
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+	err = ws.ws.Close()
 	return
 }
 
 func (ws *WebsocketConn) Send(p Payload) (err error) {
-	ws.Lock()
-	defer ws.Unlock()
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
 	log.Tracef("sending %+v", p)
 	err = ws.ws.WriteJSON(p)
 	return
 }
 
+// SendBinary sends a chunk as a binary frame
+func (ws *WebsocketConn) SendBinary(p Payload) (err error) {
+	b := make([]byte, binaryHeaderSize+len(p.Data))
+	binary.BigEndian.PutUint64(b[0:8], uint64(p.ID))
+	binary.BigEndian.PutUint32(b[8:12], uint32(p.Chunk))
+	if p.Success {
+		b[12] |= flagSuccess
+	}
+	if p.Done {
+		b[12] |= flagDone
+	}
+	copy(b[binaryHeaderSize:], p.Data)
+
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+	log.Tracef("sending binary %d/%d (%d bytes)", p.ID, p.Chunk, len(p.Data))
+	err = ws.ws.WriteMessage(websocket.BinaryMessage, b)
+	return
+}
+
+// Receive reads the next payload, which is either JSON or
+// a chunk sent as a binary frame
 func (ws *WebsocketConn) Receive() (p Payload, err error) {
-	ws.Lock()
-	defer ws.Unlock()
-	err = ws.ws.ReadJSON(&p)
+	ws.readMutex.Lock()
+	defer ws.readMutex.Unlock()
+	messageType, b, err := ws.ws.ReadMessage()
+	if err != nil {
+		return
+	}
+	if messageType == websocket.BinaryMessage {
+		if len(b) < binaryHeaderSize {
+			err = fmt.Errorf("binary frame too short (%d bytes)", len(b))
+			return
+		}
+		p = Payload{
+			ID:      int64(binary.BigEndian.Uint64(b[0:8])),
+			Type:    "chunk",
+			Chunk:   int(binary.BigEndian.Uint32(b[8:12])),
+			Success: b[12]&flagSuccess != 0,
+			Done:    b[12]&flagDone != 0,
+			Data:    b[binaryHeaderSize:],
+		}
+		log.Tracef("recv binary %d/%d (%d bytes)", p.ID, p.Chunk, len(p.Data))
+		return
+	}
+	err = json.Unmarshal(b, &p)
 	log.Tracef("recv %+v", p)
 	return
 }
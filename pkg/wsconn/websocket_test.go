@@ -0,0 +1,35 @@
+package wsconn
+
+import "testing"
+
+func TestRangeResolve(t *testing.T) {
+	tests := []struct {
+		name  string
+		r     Range
+		size  int64
+		start int64
+		end   int64
+		ok    bool
+	}{
+		{name: "closed", r: Range{Start: 2, End: 5}, size: 10, start: 2, end: 5, ok: true},
+		{name: "one byte", r: Range{Start: 9, End: 9}, size: 10, start: 9, end: 9, ok: true},
+		{name: "open-ended", r: Range{Start: 4, End: -1}, size: 10, start: 4, end: 9, ok: true},
+		{name: "end at size", r: Range{Start: 4, End: 10}, size: 10, start: 4, end: 9, ok: true},
+		{name: "end past size", r: Range{Start: 0, End: 100}, size: 10, start: 0, end: 9, ok: true},
+		{name: "suffix", r: Range{Start: -3, End: -1}, size: 10, start: 7, end: 9, ok: true},
+		{name: "suffix of everything", r: Range{Start: -10, End: -1}, size: 10, start: 0, end: 9, ok: true},
+		{name: "suffix past start", r: Range{Start: -100, End: -1}, size: 10, start: 0, end: 9, ok: true},
+		{name: "start at size", r: Range{Start: 10, End: -1}, size: 10, start: 10, end: 9},
+		{name: "start past size", r: Range{Start: 20, End: 30}, size: 10, start: 20, end: 9},
+		{name: "empty file", r: Range{Start: 0, End: -1}, size: 0, start: 0, end: -1},
+		{name: "suffix of empty file", r: Range{Start: -5, End: -1}, size: 0, start: 0, end: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, ok := tt.r.Resolve(tt.size)
+			if start != tt.start || end != tt.end || ok != tt.ok {
+				t.Errorf("got %d-%d %v, want %d-%d %v", start, end, ok, tt.start, tt.end, tt.ok)
+			}
+		})
+	}
+}
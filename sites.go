@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/schollz/hostyoself/pkg/client"
+	log "github.com/schollz/logger"
+	"github.com/urfave/cli"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// site is how a domain is hosted, from the flags of host or from a
+// site in the file given with --config
+type site struct {
+	URL            string        `yaml:"url"`
+	Domain         string        `yaml:"domain"`
+	Key            string        `yaml:"key"`
+	Folder         string        `yaml:"folder"`
+	Mounts         []string      `yaml:"mount"`
+	Proxy          string        `yaml:"proxy"`
+	Hostname       string        `yaml:"hostname"`
+	Password       string        `yaml:"password"`
+	Users          []string      `yaml:"user"`
+	Links          []string      `yaml:"link"`
+	LinkExpires    time.Duration `yaml:"link-expires"`
+	LinkDownloads  int           `yaml:"link-downloads"`
+	Exclude        []string      `yaml:"exclude"`
+	Include        []string      `yaml:"include"`
+	FollowSymlinks bool          `yaml:"follow-symlinks"`
+	AllowUpload    bool          `yaml:"allow-upload"`
+	UploadFolder   string        `yaml:"upload-folder"`
+	UploadLimit    int64         `yaml:"upload-limit"`
+	NewIdentity    bool          `yaml:"new-identity"`
+
+	// dir is the folder that relative folders are in, and label
+	// is set when requests are logged with the domain
+	dir   string
+	label bool
+}
+
+// siteFromFlags returns the site given by the flags of host. Folder
+// is left empty unless it is set, as mounts replace it. Folders of the
+// flagged options are made absolute, so that sites in the config file
+// don't take them as relative to the file.
+func siteFromFlags(c *cli.Context, flagged map[string]bool) site {
+	s := site{
+		URL:            c.String("url"),
+		Domain:         c.String("domain"),
+		Key:            c.String("key"),
+		Mounts:         c.StringSlice("mount"),
+		Proxy:          c.String("proxy"),
+		Hostname:       c.String("hostname"),
+		Password:       c.String("password"),
+		Users:          c.StringSlice("user"),
+		Links:          c.StringSlice("link"),
+		LinkExpires:    c.Duration("link-expires"),
+		LinkDownloads:  c.Int("link-downloads"),
+		Exclude:        c.StringSlice("exclude"),
+		Include:        c.StringSlice("include"),
+		FollowSymlinks: c.Bool("follow-symlinks"),
+		AllowUpload:    c.Bool("allow-upload"),
+		UploadFolder:   c.String("upload-folder"),
+		UploadLimit:    c.Int64("upload-limit"),
+		NewIdentity:    c.Bool("new-identity"),
+	}
+	if c.IsSet("folder") {
+		s.Folder = c.String("folder")
+	}
+	if flagged["folder"] {
+		s.Folder = absolute(s.Folder)
+	}
+	if flagged["mount"] {
+		mounts := make([]string, len(s.Mounts))
+		for i, mount := range s.Mounts {
+			parts := strings.SplitN(mount, "=", 2)
+			if len(parts) == 2 && parts[1] != "" {
+				mount = parts[0] + "=" + absolute(parts[1])
+			}
+			mounts[i] = mount
+		}
+		s.Mounts = mounts
+	}
+	return s
+}
+
+// absolute returns a folder relative to the working folder as an
+// absolute path, leaving ~ for expand
+func absolute(folder string) string {
+	if folder == "~" || strings.HasPrefix(folder, "~/") {
+		return folder
+	}
+	abs, err := filepath.Abs(folder)
+	if err != nil {
+		return folder
+	}
+	return abs
+}
+
+// readSites reads the sites of a config file, where each starts
+// from base so that the other options apply to all of them unless a
+// site says otherwise. Folders are relative to the file.
+func readSites(raw interface{}, file string, base site) (sites []site, err error) {
+	var list []yaml.MapSlice
+	b, err := yaml.Marshal(raw)
+	if err == nil {
+		err = yaml.Unmarshal(b, &list)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sites in '%s' should be a list", file)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no sites in '%s'", file)
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return
+	}
+	domains := make(map[string]struct{})
+	for i, raw := range list {
+		s := base
+		s.dir = dir
+		s.label = len(list) > 1
+		// the site is decoded over base, which keeps what it
+		// doesn't set
+		b, _ = yaml.Marshal(raw)
+		err = yaml.UnmarshalStrict(b, &s)
+		if err != nil {
+			return nil, fmt.Errorf("problem with site %d in '%s': %s", i+1, file, err.Error())
+		}
+		if s.Domain != "" {
+			if _, ok := domains[s.Domain]; ok {
+				return nil, fmt.Errorf("'%s' is in '%s' more than once", s.Domain, file)
+			}
+			domains[s.Domain] = struct{}{}
+		}
+		sites = append(sites, s)
+	}
+	return
+}
+
+// expand returns where a folder is, relative to the folder of the
+// site and with ~ for the home folder
+func (s site) expand(folder string) (string, error) {
+	if folder == "~" || strings.HasPrefix(folder, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, folder[1:]), nil
+	}
+	if s.dir != "" && !filepath.IsAbs(folder) {
+		return filepath.Join(s.dir, folder), nil
+	}
+	return folder, nil
+}
+
+// identityName is what the identity of a site is saved under, which
+// is the folder it serves, its mounts if it only serves those, or the
+// server it forwards requests to
+func identityName(proxy, folder string, mounts []client.Mount) string {
+	if proxy != "" {
+		return proxy
+	}
+	if folder != "" {
+		abs, err := filepath.Abs(folder)
+		if err == nil {
+			folder = abs
+		}
+		return filepath.ToSlash(folder)
+	}
+	var names []string
+	for _, m := range mounts {
+		names = append(names, "/"+m.Prefix+"="+m.Folder)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// hosted is a site being kept connected by the supervisor
+type hosted struct {
+	domain string
+	run    func() error
+}
+
+// host returns a client for the site, ready to be run
+func (s site) host() (h hosted, err error) {
+	folder := s.Folder
+	if folder == "" && len(s.Mounts) == 0 {
+		folder = "."
+	}
+	if folder != "" {
+		folder, err = s.expand(folder)
+		if err != nil {
+			return
+		}
+	}
+	var mounts []client.Mount
+	prefixes := make(map[string]struct{})
+	for _, mount := range s.Mounts {
+		parts := strings.SplitN(mount, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return h, fmt.Errorf("mount '%s' should be /prefix=folder", mount)
+		}
+		folder, errExpand := s.expand(parts[1])
+		if errExpand != nil {
+			return h, errExpand
+		}
+		m, errMount := client.NewMount(parts[0], folder)
+		if errMount != nil {
+			return h, fmt.Errorf("could not mount '%s': %s", mount, errMount.Error())
+		}
+		if _, ok := prefixes[m.Prefix]; ok {
+			return h, fmt.Errorf("/%s is mounted more than once", m.Prefix)
+		}
+		prefixes[m.Prefix] = struct{}{}
+		mounts = append(mounts, m)
+	}
+
+	// a domain or key that isn't given is the one this was
+	// hosted with last time
+	id := client.Identity{Domain: s.Domain, Key: s.Key}
+	name := identityName(s.Proxy, folder, mounts)
+	saved, ok := client.LoadIdentity(name)
+	if ok && !s.NewIdentity {
+		if id.Domain == "" && (id.Key == "" || id.Key == saved.Key) {
+			id.Domain = saved.Domain
+		}
+		if id.Key == "" && id.Domain == saved.Domain {
+			id.Key = saved.Key
+		}
+	}
+
+	cl, err := client.New(id.Domain, id.Key, s.URL, folder)
+	if err != nil {
+		return
+	}
+	// the secret is kept with the domain and key, even when they are
+	// given, so that the tokens and links printed for it keep working
+	if secret, found := client.LoadSecret(cl.Domain, cl.Key); found && !s.NewIdentity {
+		cl.Secret = secret
+	} else if err = client.SaveSecret(cl.Domain, cl.Key, cl.Secret); err != nil {
+		log.Debugf("could not save secret: %s", err.Error())
+		err = nil
+	}
+	if s.Domain == "" || s.Key == "" {
+		err = client.SaveIdentity(name, client.Identity{Domain: cl.Domain, Key: cl.Key})
+		if err != nil {
+			log.Debugf("could not save identity: %s", err.Error())
+			err = nil
+		}
+	}
+	if s.Proxy != "" {
+		log.Infof("forwarding requests to %s", s.Proxy)
+		cl.Proxy = s.Proxy
+	}
+	cl.Mounts = mounts
+	if len(cl.Mounts) > 0 && s.Folder == "" {
+		// only the mounts are served
+		cl.Folder = ""
+	}
+	cl.Hostname = s.Hostname
+	cl.Exclude = s.Exclude
+	cl.Include = s.Include
+	cl.FollowSymlinks = s.FollowSymlinks
+	if s.Password != "" || len(s.Users) > 0 {
+		cl.Passwords = make(map[string]string)
+		if s.Password != "" {
+			cl.Passwords[""] = s.Password
+		}
+		for _, user := range s.Users {
+			parts := strings.SplitN(user, ":", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return h, fmt.Errorf("user '%s' should be user:password", user)
+			}
+			cl.Passwords[parts[0]] = parts[1]
+		}
+	}
+	if s.AllowUpload {
+		log.Infof("saving uploads in '%s'", s.UploadFolder)
+		cl.Upload = s.UploadFolder
+		cl.UploadLimit = s.UploadLimit * 1024 * 1024
+	}
+	for _, p := range s.Links {
+		link := client.Link{Path: filepath.ToSlash(p), Downloads: s.LinkDownloads}
+		if s.LinkExpires > 0 {
+			link.Expires = time.Now().Add(s.LinkExpires)
+		}
+		cl.Links = append(cl.Links, link)
+	}
+	if s.label {
+		cl.Label = cl.Domain + ": "
+	}
+	return hosted{domain: cl.Domain, run: cl.Run}, nil
+}
+
+// retryDelay is how long a site waits to reconnect after it is
+// disconnected
+const retryDelay = 10 * time.Second
+
+// supervise keeps every site connected to its relay forever, each
+// reconnecting on its own when it is disconnected
+func supervise(hs []hosted) {
+	exited := make(chan int)
+	start := func(i int) {
+		log.Infof("%s: serving forever", hs[i].domain)
+		go func() {
+			err := hs[i].run()
+			if err != nil {
+				log.Debugf("%s: %s", hs[i].domain, err.Error())
+			}
+			exited <- i
+		}()
+	}
+	for i := range hs {
+		start(i)
+	}
+	for i := range exited {
+		log.Infof("%s: server disconnected, retrying in %s", hs[i].domain, retryDelay)
+		i := i
+		time.AfterFunc(retryDelay, func() {
+			start(i)
+		})
+	}
+}
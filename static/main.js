@@ -73,29 +73,12 @@ var filesize = 0;
                 type: "domain",
                 message: domain,
                 key: document.getElementById("inputKey").value,
+                binary: true,
+                credit: true,
             })
         }
 
-        var filesString = "files are";
-        var domainName = `${window.publicURL}/${domain}/`;
-        if (files.length == 1) {
-            filesString = "file is"
-            domainName += `${file.name}`
-        }
-
-        document.getElementById("consoleHeader").innerHTML =
-            `<p>Your ${filesString} available at:<br> <center><strong><a href="${domainName}" target="_blank">${domainName}</a></strong></center></p>`;
-        html = `<ul>`
-        for (i = 0; i < files.length; i++) {
-            var urlToFile = files[i].name;
-            if ('fullPath' in files[i]) {
-                urlToFile = files[i].fullPath;
-            }
-            html = html +
-                `<li><a href="/${domain}/${urlToFile}" target="_blank">/${urlToFile}</a></li>`
-        }
-        html = html + `</ul>`;
-        document.getElementById("fileList").innerHTML = html;
+        renderFiles();
         document.getElementById("filesBox").classList.add("hide");
         document.getElementById("console").classList.remove("hide");
         document.getElementById("inputKey").readOnly = "true";
@@ -106,6 +89,35 @@ var filesize = 0;
 
 var socket; // websocket
 
+// siteURL is where the relay serves the domain
+var siteURL = "";
+
+// renderFiles shows where the files are available
+function renderFiles() {
+    var domain = document.getElementById("inputDomain").value;
+    var baseURL = siteURL || `${window.publicURL}/${domain}/`;
+    var filesString = "files are";
+    var domainName = baseURL;
+    if (files.length == 1) {
+        filesString = "file is"
+        domainName += `${files[0].name}`
+    }
+
+    document.getElementById("consoleHeader").innerHTML =
+        `<p>Your ${filesString} available at:<br> <center><strong><a href="${domainName}" target="_blank">${domainName}</a></strong></center></p>`;
+    var html = `<ul>`
+    for (var i = 0; i < files.length; i++) {
+        var urlToFile = files[i].name;
+        if ('fullPath' in files[i]) {
+            urlToFile = files[i].fullPath;
+        }
+        html = html +
+            `<li><a href="${baseURL}${urlToFile}" target="_blank">/${urlToFile}</a></li>`
+    }
+    html = html + `</ul>`;
+    document.getElementById("fileList").innerHTML = html;
+}
+
 
 /* websockets */
 function socketSend(data) {
@@ -124,9 +136,179 @@ function socketSend(data) {
     }
 }
 
+// chunkSize is the number of bytes of a file sent in each chunk
+const chunkSize = 64 * 1024;
+
+// binaryFrames is set when the relay accepts chunks as binary frames
+var binaryFrames = false;
+
+// binaryChunk builds a binary frame: the request ID (8 bytes), the
+// chunk number (4 bytes), flags (1 byte) and then the raw bytes
+function binaryChunk(id, chunk, done, buffer) {
+    var frame = new Uint8Array(13 + buffer.byteLength);
+    var view = new DataView(frame.buffer);
+    view.setUint32(0, Math.floor(id / 4294967296));
+    view.setUint32(4, id % 4294967296);
+    view.setUint32(8, chunk);
+    view.setUint8(12, 1 | (done ? 2 : 0));
+    frame.set(new Uint8Array(buffer), 13);
+    return frame.buffer;
+}
+
+// cancelled holds the IDs of requests the relay no longer wants
+var cancelled = {};
+
+// creditWindow is how many chunks are sent ahead of the relay before
+// waiting for credit, which creditFrames is set when it grants
+const creditWindow = 16;
+var creditFrames = false;
+
+// credits holds the chunks each response may still send
+var credits = {};
+
+// fileETag identifies a version of a file by its modification time and size
+function fileETag(file) {
+    return `"${file.lastModified.toString(16)}-${file.size.toString(16)}"`;
+}
+
+// headerValue returns the first value of a forwarded header
+function headerValue(header, name) {
+    if (header && header[name] && header[name].length > 0) {
+        return header[name][0];
+    }
+    return "";
+}
+
+// notModified returns whether the visitor's If-None-Match or
+// If-Modified-Since headers show they already have this version
+function notModified(header, etag, file) {
+    var inm = headerValue(header, "If-None-Match");
+    if (inm != "") {
+        var tags = inm.split(",");
+        for (var i = 0; i < tags.length; i++) {
+            var tag = tags[i].trim();
+            if (tag == "*" || tag.replace(/^W\//, "") == etag) {
+                return true;
+            }
+        }
+        return false;
+    }
+    var ims = Date.parse(headerValue(header, "If-Modified-Since"));
+    if (isNaN(ims)) {
+        return false;
+    }
+    return Math.floor(file.lastModified / 1000) * 1000 <= ims;
+}
+
+// rangeApplies returns whether a range should be served given the
+// visitor's If-Range header, which must match the file's ETag or
+// modification time
+function rangeApplies(ifRange, etag, file) {
+    if (!ifRange) {
+        return true;
+    }
+    if (ifRange.startsWith('"')) {
+        return ifRange == etag;
+    }
+    var t = Date.parse(ifRange);
+    if (isNaN(t)) {
+        return false;
+    }
+    return Math.floor(file.lastModified / 1000) * 1000 <= t;
+}
+
+// sendChunks streams a file to the relay one chunk at a time,
+// reading the next slice once the previous one is sent
+function sendChunks(data, file, chunk, status) {
+    if (cancelled[data.id]) {
+        delete cancelled[data.id];
+        delete credits[data.id];
+        consoleLog(`${data.ip} [${(new Date()).toUTCString()}] /${data.message} cancelled`);
+        return
+    }
+    if (socket.bufferedAmount > 16 * chunkSize || (creditFrames && credits[data.id] <= 0)) {
+        // let the socket drain before reading more of the file
+        setTimeout(function() {
+            sendChunks(data, file, chunk, status);
+        }, 50);
+        return
+    }
+    var start = chunk * chunkSize;
+    var end = Math.min(start + chunkSize, file.size);
+    var reader = new FileReader();
+    reader.onload = function(theFile) {
+        var done = end >= file.size;
+        credits[data.id]--;
+        if (binaryFrames) {
+            socket.send(binaryChunk(data.id, chunk, done, reader.result));
+        } else {
+            socketSend({
+                id: data.id,
+                type: "chunk",
+                chunk: chunk,
+                done: done,
+                message: end > start ? reader.result : "",
+                success: true,
+                key: document.getElementById("inputKey").value,
+            })
+        }
+        if (done) {
+            delete credits[data.id];
+            consoleLog(
+                `${data.ip} [${(new Date()).toUTCString()}] /${data.message} ${status} ${file.size}`
+            );
+            return
+        }
+        sendChunks(data, file, chunk + 1, status);
+    };
+    reader.onerror = function() {
+        delete credits[data.id];
+        socketSend({
+            id: data.id,
+            type: "chunk",
+            message: "could not read file",
+            success: false,
+            key: document.getElementById("inputKey").value,
+        })
+    };
+    if (binaryFrames) {
+        reader.readAsArrayBuffer(file.slice(start, end));
+    } else {
+        reader.readAsDataURL(file.slice(start, end));
+    }
+}
+
+// sitemap describes the dropped files for the relay's listing
+function sitemap() {
+    return files.map(function(file) {
+        return {
+            fullPath: file.fullPath || "",
+            upload: {
+                uuid: file.upload ? file.upload.uuid : "",
+                total: file.size,
+                filename: file.name,
+            },
+            size: file.size,
+            modified: Math.floor(file.lastModified / 1000),
+        };
+    });
+}
+
+// findFile returns the dropped file matching the requested path
+function findFile(p) {
+    for (var i = 0; i < files.length; i++) {
+        if (files[i].webkitRelativePath == p || files[i].fullPath == p || files[i].name == p || files[i]
+            .webkitRelativePath == relativeDirectory + "/" + p || files[i]
+            .fullPath == relativeDirectory + "/" + p) {
+            return files[i];
+        }
+    }
+    return null;
+}
+
 const socketMessageListener = (event) => {
     var data = JSON.parse(event.data);
-    if (!('type' in data && 'message' in data)) {
+    if (!('type' in data)) {
         consoleLog(`[warn] got bad data ${event.data}`);
         return
     }
@@ -135,8 +317,9 @@ const socketMessageListener = (event) => {
     if (data.type == "files") {
         if (files.length > 0) {
             socketSend({
+                id: data.id,
                 type: "files",
-                message: JSON.stringify(files),
+                message: JSON.stringify(sitemap()),
                 success: true,
                 key: document.getElementById("inputKey").value,
             });
@@ -145,6 +328,7 @@ const socketMessageListener = (event) => {
             );
         } else {
             socketSend({
+                id: data.id,
                 type: "files",
                 message: "none found",
                 success: false,
@@ -155,40 +339,116 @@ const socketMessageListener = (event) => {
             );
         }
     } else if (data.type == "get") {
-        var foundFile = false
-        var iToSend = 0
-        for (i = 0; i < files.length; i++) {
-            if (files[i].webkitRelativePath == data.message || files[i].fullPath == data.message || files[i].name == data.message || files[i]
-                .webkitRelativePath == relativeDirectory + "/" + data.message || files[i]
-                .fullPath == relativeDirectory + "/" + data.message) {
-                iToSend = i;
-                var reader = new FileReader();
-                reader.onload = function(theFile) {
-                    socketSend({
-                        type: "get",
-                        message: reader.result,
-                        success: true,
-                        key: document.getElementById("inputKey").value,
-                    })
-                    consoleLog(
-                        `${data.ip} [${(new Date()).toUTCString()}] /${data.message} 200 ${files[i].size}`
-                    );
-                };
-                reader.readAsDataURL(files[i]);
-                foundFile = true
-                break
-            }
+        var method = data.method || "GET";
+        if (method != "GET" && method != "HEAD") {
+            socketSend({
+                id: data.id,
+                type: "get",
+                message: "method not allowed",
+                status: 405,
+                success: false,
+                key: document.getElementById("inputKey").value,
+            })
+            consoleLog(`${data.ip} [${(new Date()).toUTCString()}] ${method} /${data.message} 405`);
+            return
         }
-        if (foundFile == false) {
+        var file = findFile(data.message);
+        if (file == null) {
             socketSend({
+                id: data.id,
                 type: "get",
                 message: "not found",
+                status: 404,
                 success: false,
                 key: document.getElementById("inputKey").value,
             })
             consoleLog(`${data.ip} [${(new Date()).toUTCString()}] /${data.message} 404`);
+            return
+        }
+        var etag = fileETag(file);
+        var modified = Math.floor(file.lastModified / 1000);
+        var header = {
+            "Accept-Ranges": ["bytes"],
+        };
+        if (notModified(data.header, etag, file)) {
+            socketSend({
+                id: data.id,
+                type: "get",
+                success: true,
+                status: 304,
+                etag: etag,
+                modified: modified,
+                key: document.getElementById("inputKey").value,
+            })
+            consoleLog(`${data.ip} [${(new Date()).toUTCString()}] /${data.message} 304`);
+            return
+        }
+        var status = 200;
+        var blob = file;
+        if (data.range && rangeApplies(data.range.ifRange, etag, file)) {
+            var start = data.range.start;
+            var end = data.range.end;
+            if (start < 0) {
+                start = Math.max(file.size + start, 0);
+                end = file.size - 1;
+            } else if (end < 0 || end >= file.size) {
+                end = file.size - 1;
+            }
+            if (start >= file.size || start > end) {
+                socketSend({
+                    id: data.id,
+                    type: "get",
+                    message: "range not satisfiable",
+                    status: 416,
+                    header: {
+                        "Content-Range": [`bytes */${file.size}`]
+                    },
+                    success: false,
+                    key: document.getElementById("inputKey").value,
+                })
+                consoleLog(`${data.ip} [${(new Date()).toUTCString()}] /${data.message} 416`);
+                return
+            }
+            status = 206;
+            header["Content-Range"] = [`bytes ${start}-${end}/${file.size}`];
+            blob = file.slice(start, end + 1);
+        }
+        socketSend({
+            id: data.id,
+            type: "get",
+            success: true,
+            chunked: method != "HEAD",
+            status: status,
+            header: header,
+            etag: etag,
+            modified: modified,
+            size: blob.size,
+            contentType: file.type,
+            key: document.getElementById("inputKey").value,
+        })
+        if (method == "HEAD") {
+            consoleLog(`${data.ip} [${(new Date()).toUTCString()}] HEAD /${data.message} ${status}`);
+            return
+        }
+        credits[data.id] = creditWindow;
+        sendChunks(data, blob, 0, status);
+    } else if (data.type == "cancel") {
+        cancelled[data.id] = true;
+    } else if (data.type == "credit") {
+        if (data.id in credits) {
+            credits[data.id] += data.chunk;
         }
     } else if (data.type == "domain") {
+        if (data.success == false) {
+            consoleLog(`[error] ${data.message}`);
+            return
+        }
+        binaryFrames = data.binary == true;
+        creditFrames = data.credit == true;
+        if (data.url && data.url != siteURL) {
+            siteURL = data.url;
+            renderFiles();
+        }
         console.log(`[info] ${data.message}`);
     } else if (data.type == "message") {
         console.log(`[info] ${data.message}`);
@@ -204,6 +464,8 @@ const socketOpenListener = (event) => {
             type: "domain",
             message: document.getElementById("inputDomain").value,
             key: document.getElementById("inputKey").value,
+            binary: true,
+            credit: true,
         })
     }
 };